@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// AccessRequest is everything needed to decide whether someone may read (or
+// reply to) an event that may be gated behind membership tiers.
+type AccessRequest struct {
+	// authenticated pubkey of whoever is asking, empty when anonymous
+	Requester string
+	// the tiers the requester has in the event's group at the time of the
+	// request, as returned by getTiersFromMemberships
+	Tiers []string
+	Event *nostr.Event
+	// "d" values the requester explicitly asked for, full versions of
+	// articles are only handed to the group owner on exact lookups
+	RequestedDTags []string
+}
+
+type AccessDecision int
+
+const (
+	// the requester isn't entitled to the event
+	AccessDenied AccessDecision = iota
+	AccessGranted
+	// the requester is entitled to the event but didn't ask for this version of it
+	AccessHidden
+)
+
+// requesterTiers resolves the tiers a requester has in the group of the event
+func requesterTiers(memberships []Membership, event *nostr.Event, now nostr.Timestamp) []string {
+	return getTiersFromMemberships(memberships, getGroupIdFromEvent(event, "h"), now)
+}
+
+// decideAccess is the tier authorization policy. It only looks at the request,
+// with no I/O, clock or settings, so the query path and the write path can
+// share it.
+//
+//   - events without tiers ("f" tags), without a group ("h" tag) or with the
+//     "Free" tier are public
+//   - authors can always read their own events
+//   - the group owner (whose pubkey is the group id) can read everything, but
+//     events tagged "full" only when their "d" tag was asked for
+//   - everyone else needs a membership in the group with one of the event's tiers,
+//     with "Free" being assumed for people without any membership there
+func decideAccess(req AccessRequest) AccessDecision {
+	eventTiers := getTiersFromEvent(req.Event)
+	if len(eventTiers) == 0 || slices.Contains(eventTiers, "Free") {
+		return AccessGranted
+	}
+
+	groupId := getGroupIdFromEvent(req.Event, "h")
+	if groupId == "" {
+		return AccessGranted
+	}
+
+	if req.Requester == "" {
+		return AccessDenied
+	}
+
+	if req.Requester == groupId {
+		if req.Event.Tags.GetFirst([]string{"full", ""}) != nil {
+			dTag := req.Event.Tags.GetFirst([]string{"d", ""})
+			if dTag == nil || !slices.Contains(req.RequestedDTags, (*dTag)[1]) {
+				return AccessHidden
+			}
+		}
+		return AccessGranted
+	}
+
+	if req.Requester == req.Event.PubKey {
+		return AccessGranted
+	}
+
+	for _, tier := range req.Tiers {
+		if slices.Contains(eventTiers, tier) {
+			return AccessGranted
+		}
+	}
+
+	return AccessDenied
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+func TestDecideAccess(t *testing.T) {
+	const (
+		owner  = "0000000000000000000000000000000000000000000000000000000000000001"
+		author = "0000000000000000000000000000000000000000000000000000000000000002"
+		reader = "0000000000000000000000000000000000000000000000000000000000000003"
+	)
+
+	event := func(tags ...nostr.Tag) *nostr.Event {
+		return &nostr.Event{PubKey: author, Kind: 30023, Tags: tags}
+	}
+	inGroup := nostr.Tag{"h", owner}
+	gold := nostr.Tag{"f", "Gold"}
+	full := nostr.Tag{"full", "yes"}
+	article := nostr.Tag{"d", "article"}
+
+	for _, tc := range []struct {
+		name     string
+		req      AccessRequest
+		expected AccessDecision
+	}{
+		{"untiered event", AccessRequest{Requester: "", Event: event(inGroup)}, AccessGranted},
+		{"free tier", AccessRequest{Requester: "", Event: event(inGroup, gold, nostr.Tag{"f", "Free"})}, AccessGranted},
+		{"no group", AccessRequest{Requester: "", Event: event(gold)}, AccessGranted},
+		{"anonymous", AccessRequest{Requester: "", Event: event(inGroup, gold)}, AccessDenied},
+		{"owner", AccessRequest{Requester: owner, Tiers: []string{"Free"}, Event: event(inGroup, gold)}, AccessGranted},
+		{"owner, full version not asked for", AccessRequest{Requester: owner, Event: event(inGroup, gold, full, article)}, AccessHidden},
+		{"owner, full version asked for", AccessRequest{Requester: owner, Event: event(inGroup, gold, full, article), RequestedDTags: []string{"article"}}, AccessGranted},
+		{"owner, full version without d", AccessRequest{Requester: owner, Event: event(inGroup, gold, full), RequestedDTags: []string{"article"}}, AccessHidden},
+		{"author", AccessRequest{Requester: author, Tiers: []string{"Free"}, Event: event(inGroup, gold)}, AccessGranted},
+		{"member of the tier", AccessRequest{Requester: reader, Tiers: []string{"Silver", "Gold"}, Event: event(inGroup, gold)}, AccessGranted},
+		{"member of another tier", AccessRequest{Requester: reader, Tiers: []string{"Silver"}, Event: event(inGroup, gold)}, AccessDenied},
+		{"no membership", AccessRequest{Requester: reader, Tiers: []string{"Free"}, Event: event(inGroup, gold)}, AccessDenied},
+		{"no tiers resolved", AccessRequest{Requester: reader, Event: event(inGroup, gold)}, AccessDenied},
+	} {
+		if decision := decideAccess(tc.req); decision != tc.expected {
+			t.Errorf("%s: got %d, expected %d", tc.name, decision, tc.expected)
+		}
+	}
+}
+
+func TestGetTiersFromMemberships(t *testing.T) {
+	previous := s.MembershipGracePeriod
+	s.MembershipGracePeriod = time.Hour
+	t.Cleanup(func() { s.MembershipGracePeriod = previous })
+
+	const now = nostr.Timestamp(1700000000)
+	memberships := []Membership{
+		{Pubkey: "group", Tier: []string{"Gold"}, ValidUntil: now - 10},
+		{Pubkey: "group", Tier: []string{"Silver"}, ValidUntil: now - 2*3600},
+		{Pubkey: "group", Tier: []string{"Bronze"}},
+		{Pubkey: "other", Tier: []string{"Platinum"}},
+	}
+
+	for _, tc := range []struct {
+		groupId  string
+		now      nostr.Timestamp
+		expected []string
+	}{
+		// Gold lapsed but is within the grace period, Silver is past it
+		{"group", now, []string{"Gold", "Bronze"}},
+		{"group", now - 3*3600, []string{"Gold", "Silver", "Bronze"}},
+		{"other", now, []string{"Platinum"}},
+		{"none", now, []string{"Free"}},
+	} {
+		tiers := getTiersFromMemberships(memberships, tc.groupId, tc.now)
+		if !slices.Equal(tiers, tc.expected) {
+			t.Errorf("%s at %d: got %v, expected %v", tc.groupId, tc.now, tiers, tc.expected)
+		}
+	}
+}
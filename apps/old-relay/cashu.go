@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Just enough Cashu to check nutzap proofs without talking to the mint: the
+// keys of the mints we accept are loaded from recorded /v1/keys responses, and
+// each proof must carry a DLEQ proof (NUT-12) showing it was signed with them.
+// Whether the proofs were already spent at the mint can't be known offline, so
+// that's left to the creator redeeming them.
+
+// CashuProof is a NUT-00 proof as found in nutzap "proof" tags
+type CashuProof struct {
+	Amount uint64     `json:"amount"`
+	ID     string     `json:"id"`
+	Secret string     `json:"secret"`
+	C      string     `json:"C"`
+	DLEQ   *CashuDLEQ `json:"dleq"`
+}
+
+type CashuDLEQ struct {
+	E string `json:"e"`
+	S string `json:"s"`
+	R string `json:"r"`
+}
+
+// MintKeyset is a keyset as returned by a mint's /v1/keys endpoint
+type MintKeyset struct {
+	ID   string            `json:"id"`
+	Unit string            `json:"unit"`
+	Keys map[string]string `json:"keys"`
+}
+
+type mintKeyset struct {
+	ID   string
+	Unit string
+	Keys map[uint64]*btcec.PublicKey
+}
+
+// mintKeysets holds the keysets we know, by normalized mint url and keyset id.
+// It is only written to while starting.
+var mintKeysets = make(map[string]map[string]*mintKeyset)
+
+func normalizeMintURL(url string) string {
+	return strings.TrimRight(strings.TrimSpace(url), "/")
+}
+
+// loadMintKeysets reads every .json file in dir, each holding a mint's /v1/keys
+// response plus the url of the mint: {"mint": <url>, "keysets": [...]}.
+func loadMintKeysets(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var recorded struct {
+			Mint    string       `json:"mint"`
+			Keysets []MintKeyset `json:"keysets"`
+		}
+		if err := json.Unmarshal(raw, &recorded); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if recorded.Mint == "" {
+			return fmt.Errorf("%s: missing mint url", file)
+		}
+
+		mint := normalizeMintURL(recorded.Mint)
+		if mintKeysets[mint] == nil {
+			mintKeysets[mint] = make(map[string]*mintKeyset)
+		}
+		for _, keyset := range recorded.Keysets {
+			parsed, err := parseMintKeyset(keyset)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			mintKeysets[mint][parsed.ID] = parsed
+		}
+	}
+
+	return nil
+}
+
+// parseMintKeyset parses the keys of a keyset and checks they are the ones its
+// id was derived from (NUT-02).
+func parseMintKeyset(keyset MintKeyset) (*mintKeyset, error) {
+	parsed := &mintKeyset{
+		ID:   keyset.ID,
+		Unit: strings.ToLower(keyset.Unit),
+		Keys: make(map[uint64]*btcec.PublicKey, len(keyset.Keys)),
+	}
+
+	amounts := make([]uint64, 0, len(keyset.Keys))
+	for amountStr, keyHex := range keyset.Keys {
+		amount, err := strconv.ParseUint(amountStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("keyset '%s': invalid amount '%s'", keyset.ID, amountStr)
+		}
+		key, err := parseCashuPoint(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("keyset '%s': key for %d: %w", keyset.ID, amount, err)
+		}
+		parsed.Keys[amount] = key
+		amounts = append(amounts, amount)
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+
+	h := sha256.New()
+	for _, amount := range amounts {
+		h.Write(parsed.Keys[amount].SerializeCompressed())
+	}
+	if id := "00" + hex.EncodeToString(h.Sum(nil))[:14]; id != keyset.ID {
+		return nil, fmt.Errorf("keyset '%s': keys don't match the id, expected '%s'", keyset.ID, id)
+	}
+
+	return parsed, nil
+}
+
+func parseCashuPoint(pointHex string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(pointHex)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.ParsePubKey(b)
+}
+
+func parseCashuScalar(scalarHex string) (*btcec.ModNScalar, error) {
+	b, err := hex.DecodeString(scalarHex)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("invalid scalar")
+	}
+	var scalar btcec.ModNScalar
+	if overflow := scalar.SetByteSlice(b); overflow {
+		return nil, fmt.Errorf("invalid scalar")
+	}
+	return &scalar, nil
+}
+
+var cashuDomainSeparator = []byte("Secp256k1_HashToCurve_Cashu_")
+
+// hashToCurve maps a secret to a point on the curve (NUT-00)
+func hashToCurve(message []byte) (*btcec.PublicKey, error) {
+	msgHash := sha256.Sum256(append(append([]byte{}, cashuDomainSeparator...), message...))
+
+	counter := make([]byte, 4)
+	for i := uint32(0); i < 1<<16; i++ {
+		binary.LittleEndian.PutUint32(counter, i)
+		h := sha256.Sum256(append(msgHash[:], counter...))
+		if point, err := btcec.ParsePubKey(append([]byte{0x02}, h[:]...)); err == nil {
+			return point, nil
+		}
+	}
+	return nil, errors.New("no valid point found")
+}
+
+// p2pkLock returns the public key a NUT-11 secret is locked to
+func p2pkLock(secret string) (string, error) {
+	var wellKnown []json.RawMessage
+	if err := json.Unmarshal([]byte(secret), &wellKnown); err != nil || len(wellKnown) != 2 {
+		return "", fmt.Errorf("secret is not P2PK locked")
+	}
+	var kind string
+	if err := json.Unmarshal(wellKnown[0], &kind); err != nil || kind != "P2PK" {
+		return "", fmt.Errorf("secret is not P2PK locked")
+	}
+	var body struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(wellKnown[1], &body); err != nil || body.Data == "" {
+		return "", fmt.Errorf("invalid P2PK secret")
+	}
+	return strings.ToLower(body.Data), nil
+}
+
+// verifyProofDLEQ checks the NUT-12 proof that the mint key for the proof's
+// amount signed it. With A the mint key, C the unblinded signature and e, s, r
+// from the proof:
+//
+//	Y  = hash_to_curve(secret)
+//	C' = C + r*A
+//	B' = Y + r*G
+//	R1 = s*G - e*A
+//	R2 = s*B' - e*C'
+//	e == sha256(R1 || R2 || A || C'), over uncompressed hex
+func verifyProofDLEQ(proof CashuProof, mintKey *btcec.PublicKey) error {
+	if proof.DLEQ == nil {
+		return fmt.Errorf("missing DLEQ proof")
+	}
+	e, err := parseCashuScalar(proof.DLEQ.E)
+	if err != nil {
+		return fmt.Errorf("DLEQ e: %w", err)
+	}
+	s, err := parseCashuScalar(proof.DLEQ.S)
+	if err != nil {
+		return fmt.Errorf("DLEQ s: %w", err)
+	}
+	r, err := parseCashuScalar(proof.DLEQ.R)
+	if err != nil {
+		return fmt.Errorf("DLEQ r: %w", err)
+	}
+	c, err := parseCashuPoint(proof.C)
+	if err != nil {
+		return fmt.Errorf("invalid C: %w", err)
+	}
+	y, err := hashToCurve([]byte(proof.Secret))
+	if err != nil {
+		return err
+	}
+
+	var A, C, Y btcec.JacobianPoint
+	mintKey.AsJacobian(&A)
+	c.AsJacobian(&C)
+	y.AsJacobian(&Y)
+
+	var rA, rG, cBlind, bBlind btcec.JacobianPoint
+	btcec.ScalarMultNonConst(r, &A, &rA)
+	btcec.AddNonConst(&C, &rA, &cBlind)
+	btcec.ScalarBaseMultNonConst(r, &rG)
+	btcec.AddNonConst(&Y, &rG, &bBlind)
+
+	var sG, eA, r1 btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(s, &sG)
+	btcec.ScalarMultNonConst(e, &A, &eA)
+	negate(&eA)
+	btcec.AddNonConst(&sG, &eA, &r1)
+
+	var sB, eC, r2 btcec.JacobianPoint
+	btcec.ScalarMultNonConst(s, &bBlind, &sB)
+	btcec.ScalarMultNonConst(e, &cBlind, &eC)
+	negate(&eC)
+	btcec.AddNonConst(&sB, &eC, &r2)
+
+	h := sha256.New()
+	for _, point := range []*btcec.JacobianPoint{&r1, &r2, &A, &cBlind} {
+		point.ToAffine()
+		if (point.X.IsZero() && point.Y.IsZero()) || point.Z.IsZero() {
+			return fmt.Errorf("invalid DLEQ proof")
+		}
+		h.Write([]byte(hex.EncodeToString(btcec.NewPublicKey(&point.X, &point.Y).SerializeUncompressed())))
+	}
+
+	var expected btcec.ModNScalar
+	expected.SetByteSlice(h.Sum(nil))
+	if !expected.Equals(e) {
+		return fmt.Errorf("invalid DLEQ proof")
+	}
+	return nil
+}
+
+func negate(point *btcec.JacobianPoint) {
+	point.ToAffine()
+	point.Y.Negate(1).Normalize()
+}
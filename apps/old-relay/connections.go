@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// clientConnection is the websocket ctx comes from, or nil for contexts that
+// don't come from a client connection, like the ones our own background jobs
+// use to add events.
+func clientConnection(ctx context.Context) *khatru.WebSocket {
+	return fromKhatru(ctx, khatru.GetConnection)
+}
+
+// fromKhatru calls one of khatru's context getters, which panic when what they
+// look for isn't in the context: our background jobs have no connection and only
+// REQs have a subscription. The failed type assertion is the only panic we
+// recover from, anything else goes on.
+func fromKhatru[T any](ctx context.Context, get func(context.Context) T) (value T) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*runtime.TypeAssertionError); !ok {
+				panic(r)
+			}
+		}
+	}()
+	return get(ctx)
+}
+
+// subscriptionID is the id of the REQ ctx comes from. It is empty when khatru
+// queries on its own while handling a write, to find the target of a deletion or
+// the version of a replaceable event being replaced.
+func subscriptionID(ctx context.Context) string {
+	return fromKhatru(ctx, khatru.GetSubscriptionID)
+}
+
+// connections are the open websockets, so we can reach people who are online,
+// with the pubkey each one authenticated as once we've seen it in one of our
+// hooks. khatru sets ws.AuthedPublicKey without a lock we can take, so reading
+// it from anywhere else would race with the AUTH being handled.
+var connections sync.Map // *khatru.WebSocket -> authed pubkey, "" until known
+
+func trackConnection(ctx context.Context) {
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		connections.Store(ws, "")
+	}
+}
+
+// rememberAuthedPubkey records who ws authenticated as, unless it was closed
+func rememberAuthedPubkey(ws *khatru.WebSocket, pubkey string) {
+	connections.CompareAndSwap(ws, "", pubkey)
+}
+
+func untrackConnection(ctx context.Context) {
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		connections.Delete(ws)
+	}
+}
+
+// notifyPubkey sends a NOTICE to every connection authenticated as pubkey
+func notifyPubkey(pubkey string, msg string) {
+	connections.Range(func(key, authed any) bool {
+		ws := key.(*khatru.WebSocket)
+		if authed.(string) == pubkey {
+			notice := nostr.NoticeEnvelope(msg)
+			if err := ws.WriteJSON(notice); err != nil {
+				log.Warn().Err(err).Str("pubkey", pubkey).Msg("failed to send notice")
+			}
+		}
+		return true
+	})
+}
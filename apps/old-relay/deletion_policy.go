@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DeletionRecord is an entry in the deletion audit log, written for every
+// deletion we accept or refuse, be it a NIP-09 request or a kind 9005.
+type DeletionRecord struct {
+	At       nostr.Timestamp `json:"at"`
+	Deletion string          `json:"deletion"`
+	By       string          `json:"by"`
+	Target   string          `json:"target"`
+	Kind     int             `json:"kind"`
+	Author   string          `json:"author"`
+	Group    string          `json:"group,omitempty"`
+	Allowed  bool            `json:"allowed"`
+	Reason   string          `json:"reason"`
+}
+
+// deletionWindow is how long after its creation the author can still delete
+// an event. Group settings take precedence over kind settings, which take
+// precedence over the default. Zero means forever.
+func deletionWindow(groupId string, kind int) time.Duration {
+	if window, ok := s.DeletionWindowByGroup[groupId]; ok && groupId != "" {
+		return window
+	}
+	if window, ok := s.DeletionWindowByKind[kind]; ok {
+		return window
+	}
+	return s.DeletionWindow
+}
+
+// decideDeletion is the whole deletion policy:
+//   - authors of long-form content can always delete it
+//   - authors of anything else can delete it within the deletion window
+//   - the group owner, admins with the delete-event permission and the relay
+//     itself can delete anything in the group
+func decideDeletion(ctx context.Context, target, deletion *nostr.Event) (allowed bool, reason string) {
+	groupId := getGroupIdFromEvent(target, "h")
+
+	if deletion.PubKey == target.PubKey {
+		if slices.Contains(contentKinds, target.Kind) {
+			return true, "author deleting long-form content"
+		}
+
+		window := deletionWindow(groupId, target.Kind)
+		if window == 0 || target.CreatedAt.Time().Add(window).After(time.Now()) {
+			return true, "author deleting within window"
+		}
+		return false, fmt.Sprintf("can't delete events older than %s, contact relay admin", window)
+	}
+
+	if deletion.PubKey == s.RelayPubkey {
+		return true, "relay"
+	}
+
+	if groupId != "" {
+		if group := groups.Snapshot(ctx, groupId, false); group != nil && group.can(deletion.PubKey, PermDeleteEvent) {
+			return true, "group admin"
+		}
+	}
+
+	return false, "you are not the author of this event"
+}
+
+// deletionPolicy decides on NIP-09 deletion requests, see decideDeletion.
+func deletionPolicy(ctx context.Context, target, deletion *nostr.Event) (acceptDeletion bool, msg string) {
+	allowed, reason := decideDeletion(ctx, target, deletion)
+	recordDeletion(target, deletion, allowed, reason)
+
+	if allowed {
+		return true, ""
+	}
+	return false, reason
+}
+
+func recordDeletion(target, deletion *nostr.Event, allowed bool, reason string) {
+	record := DeletionRecord{
+		At:       nostr.Now(),
+		Deletion: deletion.ID,
+		By:       deletion.PubKey,
+		Target:   target.ID,
+		Kind:     target.Kind,
+		Author:   target.PubKey,
+		Group:    getGroupIdFromEvent(target, "h"),
+		Allowed:  allowed,
+		Reason:   reason,
+	}
+
+	log.Info().Str("target", record.Target).Int("kind", record.Kind).Str("author", record.Author).
+		Str("by", record.By).Str("group", record.Group).Bool("allowed", allowed).Str("reason", reason).
+		Msg("deletion decision")
+
+	// keys sort by time so the log can be read in order
+	key := fmt.Sprintf("%020d:%s:%s", record.At, record.Deletion, record.Target)
+	if err := state.Put("deletions", key, record); err != nil {
+		log.Error().Err(err).Str("target", record.Target).Msg("failed to write deletion audit record")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDeletionWindowPrecedence(t *testing.T) {
+	setupTestRelay(t)
+	s.DeletionWindow = 2 * time.Hour
+	s.DeletionWindowByKind = map[int]time.Duration{9: 10 * time.Minute}
+	s.DeletionWindowByGroup = map[string]time.Duration{"forever": 0, "": time.Minute}
+
+	for name, tc := range map[string]struct {
+		group    string
+		kind     int
+		expected time.Duration
+	}{
+		"default":              {"other", 1, 2 * time.Hour},
+		"kind over default":    {"other", 9, 10 * time.Minute},
+		"group over kind":      {"forever", 9, 0},
+		"no group isn't a key": {"", 1, 2 * time.Hour},
+	} {
+		if window := deletionWindow(tc.group, tc.kind); window != tc.expected {
+			t.Errorf("%s: got %s, expected %s", name, window, tc.expected)
+		}
+	}
+}
+
+func TestDecideDeletion(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	s.DeletionWindow = time.Hour
+
+	authorSk := nostr.GeneratePrivateKey()
+	adminSk := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminSk)
+	memberSk := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSk)
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+
+	for _, evt := range []*nostr.Event{
+		signEvent(t, s.RelayPrivkey, 9000, 1000, nostr.Tags{{"h", owner}, {"p", member}, {"p", admin}}, ""),
+		signEvent(t, s.RelayPrivkey, 9003, 1001, nostr.Tags{{"h", owner}, {"p", admin}, {"permission", PermDeleteEvent}}, ""),
+	} {
+		if err := groups.Apply(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := nostr.Now() - 2*60*60
+	recent := nostr.Now() - 60
+	for name, tc := range map[string]struct {
+		target  *nostr.Event
+		deleter string
+		allowed bool
+	}{
+		"author within window":      {signEvent(t, authorSk, 9, recent, nostr.Tags{{"h", owner}}, ""), authorSk, true},
+		"author past window":        {signEvent(t, authorSk, 9, old, nostr.Tags{{"h", owner}}, ""), authorSk, false},
+		"author of long-form":       {signEvent(t, authorSk, 30023, old, nostr.Tags{{"h", owner}, {"d", "a"}}, ""), authorSk, true},
+		"relay":                     {signEvent(t, authorSk, 9, old, nostr.Tags{{"h", owner}}, ""), s.RelayPrivkey, true},
+		"admin who can delete":      {signEvent(t, authorSk, 9, old, nostr.Tags{{"h", owner}}, ""), adminSk, true},
+		"owner":                     {signEvent(t, authorSk, 9, old, nostr.Tags{{"h", owner}}, ""), ownerSk, true},
+		"member":                    {signEvent(t, authorSk, 9, recent, nostr.Tags{{"h", owner}}, ""), memberSk, false},
+		"admin outside their group": {signEvent(t, authorSk, 9, recent, nostr.Tags{{"h", "elsewhere"}}, ""), adminSk, false},
+	} {
+		deletion := signEvent(t, tc.deleter, 5, nostr.Now(), nostr.Tags{{"e", tc.target.ID}}, "")
+		if allowed, reason := decideDeletion(ctx, tc.target, deletion); allowed != tc.allowed {
+			t.Errorf("%s: got %v (%s), expected %v", name, allowed, reason, tc.allowed)
+		}
+	}
+}
+
+// khatru finds deletion targets through our query handlers, which mustn't hide
+// them from deleters who can't read them
+func TestDeletingGatedEventsWithoutAccess(t *testing.T) {
+	url := startTestRelay(t)
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(context.Background(), owner, owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+
+	authorSk := nostr.GeneratePrivateKey()
+	for name, tc := range map[string]struct {
+		deleterSk string
+		tags      nostr.Tags
+	}{
+		// the author hasn't authenticated, so they can't read it
+		"anonymous author": {authorSk, nil},
+		// the owner can read everything, but not versions tagged "full" unless
+		// asked for by "d"
+		"group owner": {ownerSk, nostr.Tags{{"full", ""}}},
+	} {
+		tags := append(nostr.Tags{{"h", owner}, {"f", "gold"}, {"d", name}}, tc.tags...)
+		target := signEvent(t, authorSk, 30023, nostr.Now(), tags, "paid")
+		saveTestEvent(t, target)
+
+		client := connectTestClient(t, url, "")
+		deletion := signEvent(t, tc.deleterSk, 5, nostr.Now(), nostr.Tags{{"e", target.ID}}, "")
+		if ok, reason := client.publish(deletion); !ok {
+			t.Fatalf("%s: deletion refused: %s", name, reason)
+		}
+		if n, _ := db.CountEvents(context.Background(), nostr.Filter{IDs: []string{target.ID}}); n != 0 {
+			t.Errorf("%s: the deletion was accepted but the event is still there", name)
+		}
+	}
+}
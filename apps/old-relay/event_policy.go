@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"slices"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -20,36 +19,28 @@ func requireHTag(ctx context.Context, event *nostr.Event) (reject bool, msg stri
 }
 
 /**
- * Events must tag an event that
+ * Events can only tag events their author has access to
  */
 func onlyMembersCanWrite(ctx context.Context, event *nostr.Event, groupId string, eTags nostr.Tags) (reject bool, msg string) {
-	// get the tiers this user has on this group
-	activeTiers := getTiersForPubkeyOnGroup(ctx, event.PubKey, groupId)
-
-	fmt.Println("activeTiers: ", activeTiers)
+	memberships := loadMemberships(ctx, event.PubKey)
 
 	// get the tagged events
-	taggedEvents, _ := getTaggedEvents(ctx, event, groupId, eTags)
-
-	for taggedEvent := range taggedEvents {
-		// get the tier of the tagged events
-		eventTiers := getTiersFromEvent(taggedEvent)
-
-		// if it doesn't have a tier, allow
-		if len(eventTiers) == 0 {
-			continue
-		}
-
-		eventCanBeTagged := false
-
-		for _, tier := range eventTiers {
-			if tier == "Free" || slices.Contains(activeTiers, tier) {
-				eventCanBeTagged = true
-				break
-			}
-		}
+	ch, err := getTaggedEvents(ctx, event, groupId, eTags)
+	if err != nil {
+		return true, "error: failed to load tagged events"
+	}
+	taggedEvents := make([]*nostr.Event, 0, len(eTags))
+	for taggedEvent := range ch {
+		taggedEvents = append(taggedEvents, taggedEvent)
+	}
 
-		if !eventCanBeTagged {
+	now := nostr.Now()
+	for _, taggedEvent := range taggedEvents {
+		if decideAccess(AccessRequest{
+			Requester: event.PubKey,
+			Tiers:     requesterTiers(memberships, taggedEvent, now),
+			Event:     taggedEvent,
+		}) == AccessDenied {
 			return true, "insufficient permissions"
 		}
 	}
@@ -109,6 +100,12 @@ func enforceGroupEvents(ctx context.Context, event *nostr.Event) (reject bool, m
 		return false, ""
 	}
 
+	// payments come from people who aren't members yet (or from their wallets),
+	// validateNutzaps and validateZapReceipts check them
+	if event.Kind == 9321 || event.Kind == 9735 {
+		return false, ""
+	}
+
 	var checks []func(context.Context, *nostr.Event, string, nostr.Tags) (bool, string)
 
 	if groupId != event.PubKey {
@@ -149,7 +146,7 @@ func restrictGroupWritesToMembers(ctx context.Context, event *nostr.Event) (reje
 	}
 
 	groupId := (*gtag)[1]
-	group := loadGroup(ctx, groupId, true)
+	group := groups.Get(ctx, groupId, true)
 
 	// if there is no group, allow
 	if group == nil {
@@ -205,110 +202,105 @@ func restrictInvalidModerationActions(ctx context.Context, event *nostr.Event) (
 		return true, "invalid moderation action: " + err.Error()
 	}
 
-	gtag := event.Tags.GetFirst([]string{"h", ""})
-	groupId := (*gtag)[1]
-	group := loadGroup(ctx, groupId, true)
+	groupId := getGroupIdFromEvent(event, "h")
+	if groupId == "" {
+		return true, "missing group ('h') tag"
+	}
+	group := groups.Snapshot(ctx, groupId, true)
 
-	fmt.Println("groupId: ", groupId, group)
+	if assign, ok := action.(*AssignRole); ok && assign.Name != "" {
+		if _, exists := group.Roles[assign.Name]; !exists {
+			return true, "unknown role '" + assign.Name + "'"
+		}
+	}
 
 	// if h tag is the same as the event.pubkey, allow
 	if groupId == event.PubKey || event.PubKey == s.RelayPubkey {
-		fmt.Println("groupId == event.PubKey: allow moderation action")
 		return false, ""
 	}
 
-	groupIdDoesntLookLikePubkey := len(groupId) != 64
-
-	if (group == nil && groupIdDoesntLookLikePubkey) && groupId != event.PubKey {
-		role, ok := group.Members[event.PubKey]
-		if !ok || role == emptyRole {
-			return true, "unknown admin"
-		}
-
-		if _, ok := role.Permissions[action.PermissionName()]; !ok {
-			return true, "insufficient permissions"
-		}
+	if role, ok := group.Members[event.PubKey]; !ok || role == emptyRole {
+		return true, "unknown admin"
+	}
+	if !group.can(event.PubKey, action.PermissionName()) {
+		return true, "insufficient permissions"
 	}
 
 	return false, ""
 }
 
-func rateLimit(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-	gtag := event.Tags.GetFirst([]string{"h", ""})
-	if gtag == nil {
+func applyModerationAction(ctx context.Context, event *nostr.Event) {
+	if (event.Kind < 9000 || event.Kind > 9020) && event.Kind != 39002 {
+		return
+	}
+	if _, ok := moderationActionFactories[event.Kind]; !ok {
 		return
 	}
 
-	groupId := (*gtag)[1]
-	group := loadGroup(ctx, groupId, true)
-
-	if rsv := group.bucket.Reserve(); rsv.Delay() != 0 {
-		rsv.Cancel()
-		return true, "rate-limited"
-	} else {
-		rsv.OK()
+	if err := groups.Apply(ctx, event); err != nil {
+		log.Warn().Err(err).Stringer("event", event).Msg("failed to apply moderation action")
 		return
 	}
-}
 
-func applyModerationAction(ctx context.Context, event *nostr.Event) {
-	fmt.Println("applyModerationAction %d", event.Kind)
+	groupId := getGroupIdFromEvent(event, "h")
 
-	if event.Kind < 9000 || event.Kind > 9020 {
-		return
+	// whoever is removed stops being listed as a paying member too
+	if event.Kind == 9001 {
+		if action, err := moderationActionFactories[event.Kind](event); err == nil {
+			for _, target := range action.(*RemoveUser).Targets {
+				if _, err := dropPaidMembership(groupId, target); err != nil {
+					log.Error().Err(err).Str("group", groupId).Str("pubkey", target).Msg("failed to cancel membership of removed user")
+				}
+			}
+		}
 	}
-	makeModerationAction, ok := moderationActionFactories[event.Kind]
-	if !ok {
+
+	if err := refreshGroupEvents(ctx, groupId); err != nil {
+		log.Error().Err(err).Str("group", groupId).Msg("failed to publish group events")
+	}
+}
+
+// deleteModeratedEvents removes the events targeted by a kind 9005 from the
+// store. Only events from the same group are touched, and moderation events are
+// kept since the group state is derived from them.
+func deleteModeratedEvents(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 9005 {
 		return
 	}
-	action, err := makeModerationAction(event)
+	action, err := moderationActionFactories[event.Kind](event)
 	if err != nil {
 		return
 	}
-	gtag := event.Tags.GetFirst([]string{"h", ""})
-	groupId := (*gtag)[1]
-	group := loadGroup(ctx, groupId, true)
-
-	if group == nil {
-		fmt.Println("group is nil")
+	groupId := getGroupIdFromEvent(event, "h")
+	if groupId == "" {
 		return
 	}
 
-	action.Apply(group)
-}
-
-func reactToJoinRequest(ctx context.Context, event *nostr.Event) {
-	if event.Kind != 9021 {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{
+		IDs:  action.(*DeleteEvent).Targets,
+		Tags: nostr.TagMap{"h": []string{groupId}},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("group", groupId).Msg("failed to query events to delete")
 		return
 	}
-	gtag := event.Tags.GetFirst([]string{"h", ""})
-	groupId := (*gtag)[1]
-	group := loadGroup(ctx, groupId, true)
-
-	if !group.Closed {
-		// immediatelly add the requester
-		addUser := &nostr.Event{
-			CreatedAt: nostr.Now(),
-			Kind:      9000,
-			Tags: nostr.Tags{
-				nostr.Tag{"p", event.PubKey},
-			},
-		}
-		if err := addUser.Sign(s.RelayPrivkey); err != nil {
-			log.Error().Err(err).Msg("failed to sign add-user event")
-			return
-		}
-		if err := relay.AddEvent(ctx, addUser); err != nil {
-			log.Error().Err(err).Msg("failed to add user who requested to join")
-			return
-		}
-	}
-}
 
-func blockDeletesOfOldMessages(ctx context.Context, target, deletion *nostr.Event) (acceptDeletion bool, msg string) {
-	if target.CreatedAt < nostr.Now()-60*60*2 /* 2 hours */ {
-		return false, "can't delete old event, contact relay admin"
+	// collect everything before deleting so we're not writing while the query is still reading
+	targets := make([]*nostr.Event, 0, len(action.(*DeleteEvent).Targets))
+	for target := range ch {
+		targets = append(targets, target)
 	}
 
-	return true, ""
+	for _, target := range targets {
+		if _, isModeration := moderationActionFactories[target.Kind]; isModeration {
+			recordDeletion(target, event, false, "moderation events can't be deleted")
+			continue
+		}
+
+		if err := deleteEvent(ctx, target); err != nil {
+			log.Error().Err(err).Str("group", groupId).Str("target", target.ID).Msg("failed to delete event")
+			continue
+		}
+		recordDeletion(target, event, true, "moderation action")
+	}
 }
@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"slices"
 
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
 )
 
+// requireAuth asks anonymous readers to AUTH when everything their filter could
+// match is gated, going by the visibility index.
 func requireAuth(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
 	pubkey := khatru.GetAuthed(ctx)
 
@@ -16,25 +16,12 @@ func requireAuth(ctx context.Context, filter nostr.Filter) (reject bool, msg str
 		return false, ""
 	}
 
-	// run the query, if it only returns events that are not public, request auth
-	queryChannel, _ := db.QueryEvents(ctx, filter)
-
-	nonPublicEvents := 0
-
-	for event := range queryChannel {
-		eventTiers := getTiersFromEvent(event)
-
-		if len(eventTiers) == 0 || slices.Contains(eventTiers, "Free") {
-			// if we have a public event, we don't need to request auth
-			fmt.Println("public event found")
-			return false, ""
-		} else {
-			nonPublicEvents++
-			fmt.Println("non-public event found")
-		}
+	gated, err := onlyGatedEvents(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to check visibility index")
+		return false, ""
 	}
-
-	if nonPublicEvents > 0 {
+	if gated {
 		return true, "auth-required: authenticate please"
 	}
 
@@ -44,15 +31,13 @@ func requireAuth(ctx context.Context, filter nostr.Filter) (reject bool, msg str
 func requireKindAndSingleGroupID(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
 	pubkey := khatru.GetAuthed(ctx)
 
-	fmt.Println("pubkey:", pubkey)
+	log.Debug().Str("pubkey", pubkey).Interface("filter", filter).Msg("checking filter kinds and group")
 
 	// if there is no pubkey, send back auth-required
 	// if pubkey == "" {
 	// 	return true, "auth-required: something"
 	// }
 
-	fmt.Println("pubkey:", pubkey)
-
 	// isMeta := false
 	isNormal := false
 	for _, kind := range filter.Kinds {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// When EncryptGatedContent is on, the content of events gated behind paid
+// tiers is NIP-44 encrypted by the relay to itself before being stored, so
+// anything reading straight from the database only ever sees ciphertext. When
+// the content is delivered to an entitled subscriber it is re-encrypted from
+// the relay to their pubkey and tagged with ["relay-encrypted", <relay pubkey>]
+// so they know who to decrypt it with. Authors get their event back exactly as
+// they published it.
+const relayEncryptedTag = "relay-encrypted"
+
+// maxGatedContent is the longest content that still fits in the database once
+// sealed: the database takes up to 65535 bytes, and 40960 bytes are padded to
+// a NIP-44 payload that encodes to 54704, while anything longer is padded to
+// 49152 bytes and no longer fits.
+const maxGatedContent = 40960
+
+var conversationKeys sync.Map // pubkey -> conversation key with the relay
+
+func relayConversationKey(pubkey string) ([]byte, error) {
+	if key, ok := conversationKeys.Load(pubkey); ok {
+		return key.([]byte), nil
+	}
+	key, err := nip44ConversationKey(s.RelayPrivkey, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	conversationKeys.Store(pubkey, key)
+	return key, nil
+}
+
+// isGated tells if an event is only for members of some paid tier
+func isGated(event *nostr.Event) bool {
+	tiers := getTiersFromEvent(event)
+	return len(tiers) > 0 && !slices.Contains(tiers, "Free")
+}
+
+// isSealed tells if the content was encrypted by us. Only the relay adds the
+// tag, clients can't send it (see rejectRelayEncryptedEvents).
+func isSealed(event *nostr.Event) bool {
+	return event.Tags.GetFirst([]string{relayEncryptedTag, s.RelayPubkey}) != nil
+}
+
+// rejectRelayEncryptedEvents keeps clients from storing events that look
+// sealed by the relay, which would have us decrypt whatever they put in there
+// and hand the plaintext to readers.
+func rejectRelayEncryptedEvents(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.Tags.GetFirst([]string{relayEncryptedTag}) != nil {
+		return true, "invalid: the '" + relayEncryptedTag + "' tag is reserved to the relay"
+	}
+	return false, ""
+}
+
+// storeEvent saves events to the database, sealing the content of gated events
+// first if we're configured to do so.
+func storeEvent(ctx context.Context, event *nostr.Event) error {
+	if !s.EncryptGatedContent || !isGated(event) || event.Content == "" {
+		return db.SaveEvent(ctx, event)
+	}
+
+	if len(event.Content) > maxGatedContent {
+		return fmt.Errorf("invalid: gated content can't be longer than %d bytes", maxGatedContent)
+	}
+	sealed, err := sealContent(event)
+	if err != nil {
+		log.Error().Err(err).Str("event", event.ID).Msg("failed to encrypt gated content")
+		return fmt.Errorf("error: failed to encrypt content")
+	}
+	return db.SaveEvent(ctx, sealed)
+}
+
+// sealContent returns a copy of the event with its content encrypted from the
+// relay to itself. The id and signature are kept so the original can be
+// restored later.
+func sealContent(event *nostr.Event) (*nostr.Event, error) {
+	key, err := relayConversationKey(s.RelayPubkey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := nip44Encrypt(event.Content, key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := *event
+	sealed.Content = ciphertext
+	sealed.Tags = make(nostr.Tags, 0, len(event.Tags)+1)
+	sealed.Tags = append(sealed.Tags, event.Tags...)
+	sealed.Tags = append(sealed.Tags, nostr.Tag{relayEncryptedTag, s.RelayPubkey})
+	return &sealed, nil
+}
+
+// unsealContent turns a sealed event back into the one the author published.
+// Only content encrypted by the relay to itself is ever decrypted.
+func unsealContent(event *nostr.Event) error {
+	tag := event.Tags.GetFirst([]string{relayEncryptedTag, ""})
+	if tag == nil {
+		return nil
+	}
+	if (*tag)[1] != s.RelayPubkey {
+		return fmt.Errorf("content was not sealed by this relay")
+	}
+	key, err := relayConversationKey(s.RelayPubkey)
+	if err != nil {
+		return err
+	}
+	plaintext, err := nip44Decrypt(event.Content, key)
+	if err != nil {
+		return err
+	}
+
+	tags := make(nostr.Tags, 0, len(event.Tags)-1)
+	for _, t := range event.Tags {
+		if len(t) > 0 && t[0] == relayEncryptedTag {
+			continue
+		}
+		tags = append(tags, t)
+	}
+	event.Tags = tags
+	event.Content = plaintext
+	return nil
+}
+
+// resealContent encrypts the (unsealed) content of an event to the given reader.
+func resealContent(event *nostr.Event, readerPubkey string) error {
+	key, err := relayConversationKey(readerPubkey)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := nip44Encrypt(event.Content, key)
+	if err != nil {
+		return err
+	}
+
+	event.Content = ciphertext
+	event.Tags = append(event.Tags, nostr.Tag{relayEncryptedTag, s.RelayPubkey})
+	return nil
+}
+
+// prepareSealedEvent gets a sealed event ready to be delivered to requesterPubkey,
+// who must already have been found entitled to it. It returns false if the
+// event can't be delivered at all.
+func prepareSealedEvent(event *nostr.Event, requesterPubkey string) bool {
+	if !isSealed(event) {
+		return true
+	}
+
+	// there is no one to encrypt to
+	if requesterPubkey == "" {
+		return false
+	}
+
+	if err := unsealContent(event); err != nil {
+		log.Error().Err(err).Str("event", event.ID).Msg("failed to decrypt stored gated content")
+		return false
+	}
+	if requesterPubkey == event.PubKey {
+		return true
+	}
+	if err := resealContent(event, requesterPubkey); err != nil {
+		log.Error().Err(err).Str("event", event.ID).Str("reader", requesterPubkey).
+			Msg("failed to encrypt gated content to reader")
+		return false
+	}
+	return true
+}
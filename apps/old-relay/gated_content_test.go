@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRelayEncryptedTagIsReserved(t *testing.T) {
+	setupTestRelay(t)
+
+	sk := nostr.GeneratePrivateKey()
+	for _, tags := range []nostr.Tags{
+		{{"h", "group"}, {relayEncryptedTag, s.RelayPubkey}},
+		{{"h", "group"}, {relayEncryptedTag}},
+	} {
+		evt := signEvent(t, sk, 9, nostr.Now(), tags, "ciphertext")
+		if reject, _ := rejectRelayEncryptedEvents(context.Background(), evt); !reject {
+			t.Errorf("event with tags %v should be rejected", tags)
+		}
+	}
+
+	evt := signEvent(t, sk, 9, nostr.Now(), nostr.Tags{{"h", "group"}}, "hello")
+	if reject, msg := rejectRelayEncryptedEvents(context.Background(), evt); reject {
+		t.Errorf("plain event rejected: %s", msg)
+	}
+}
+
+func TestUnsealOnlyDecryptsRelayContent(t *testing.T) {
+	setupTestRelay(t)
+
+	sk := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(sk)
+	evt := signEvent(t, sk, 9, nostr.Now(), nostr.Tags{{"h", "group"}, {"f", "gold"}}, "secret")
+
+	sealed, err := sealContent(evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || sealed.Content == "secret" {
+		t.Fatal("content wasn't sealed")
+	}
+	if !prepareSealedEvent(sealed, author) || sealed.Content != "secret" || isSealed(sealed) {
+		t.Fatal("author should get their event back as published")
+	}
+
+	// a ciphertext addressed to someone else, relabeled so we'd decrypt it
+	reader := nostr.GeneratePrivateKey()
+	readerPubkey, _ := nostr.GetPublicKey(reader)
+	sealed, _ = sealContent(evt)
+	prepareSealedEvent(sealed, readerPubkey)
+	forged := *sealed
+	forged.Tags = nostr.Tags{{"h", "group"}, {"f", "gold"}, {relayEncryptedTag, readerPubkey}}
+	if isSealed(&forged) {
+		t.Error("content sealed to a reader shouldn't count as sealed by the relay")
+	}
+	if err := unsealContent(&forged); err == nil || forged.Content == "secret" {
+		t.Error("content not sealed by the relay was decrypted")
+	}
+}
+
+func TestNonMembersDontGetSealedContent(t *testing.T) {
+	url := startTestRelay(t)
+	s.EncryptGatedContent = true
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(context.Background(), owner, owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+
+	author := connectTestClient(t, url, ownerSk)
+	note := signEvent(t, ownerSk, 9, nostr.Now(), nostr.Tags{{"h", owner}, {"f", "gold"}}, "secret")
+	if ok, reason := author.publish(note); !ok {
+		t.Fatal(reason)
+	}
+
+	// what's on disk is sealed, the author still gets what they wrote
+	stored, err := db.QueryEvents(context.Background(), nostr.Filter{IDs: []string{note.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for evt := range stored {
+		if !isSealed(evt) || strings.Contains(evt.Content, "secret") {
+			t.Errorf("stored content wasn't sealed: %q", evt.Content)
+		}
+	}
+	if got := author.query(nostr.Filter{IDs: []string{note.ID}}); len(got) != 1 || got[0].Content != "secret" {
+		t.Errorf("the author didn't get their event back: %v", got)
+	}
+
+	reader := connectTestClient(t, url, nostr.GeneratePrivateKey())
+	for _, evt := range reader.query(nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": []string{owner}}}) {
+		if evt.ID == note.ID && evt.Content != "" && !isSealed(evt) {
+			t.Errorf("a non-member got the content %q", evt.Content)
+		}
+	}
+}
+
+func TestGatedContentTooLongToEncrypt(t *testing.T) {
+	setupTestRelay(t)
+	s.EncryptGatedContent = true
+
+	sk := nostr.GeneratePrivateKey()
+	longest := signEvent(t, sk, 30023, nostr.Now(), nostr.Tags{{"d", "longest"}, {"f", "gold"}}, strings.Repeat("a", maxGatedContent))
+	if err := storeEvent(context.Background(), longest); err != nil {
+		t.Fatal(err)
+	}
+
+	evt := signEvent(t, sk, 30023, nostr.Now(), nostr.Tags{{"d", "long"}, {"f", "gold"}}, strings.Repeat("a", maxGatedContent+1))
+	err := storeEvent(context.Background(), evt)
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid: ") {
+		t.Fatalf("expected the event to be refused as invalid, got %v", err)
+	}
+}
+
+func TestLiveSubscribersOnlyGetWhatTheyreEntitledTo(t *testing.T) {
+	url := startTestRelay(t)
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(context.Background(), owner, owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := connectTestClient(t, url, nostr.GeneratePrivateKey())
+	reader.subscribe("live", nostr.Filter{Kinds: []int{9, 30023}, Tags: nostr.TagMap{"h": []string{owner}}})
+
+	author := connectTestClient(t, url, ownerSk)
+	note := signEvent(t, ownerSk, 9, nostr.Now(), nostr.Tags{{"h", owner}, {"f", "gold"}}, "secret")
+	if ok, reason := author.publish(note); !ok {
+		t.Fatal(reason)
+	}
+	got := reader.receive("live")
+	if got == nil || got.ID != note.ID {
+		t.Fatalf("expected the note, got %v", got)
+	}
+	if got.Content != "" || got.Sig != "" {
+		t.Fatalf("gated content was broadcast: %v", got)
+	}
+
+	article := signEvent(t, ownerSk, 30023, nostr.Now(),
+		nostr.Tags{{"h", owner}, {"f", "gold"}, {"d", "post"}, {"title", "Post"}}, "first\n\nsecond")
+	if ok, reason := author.publish(article); !ok {
+		t.Fatal(reason)
+	}
+	teaser := reader.receive("live")
+	if teaser == nil || teaser.PubKey != s.RelayPubkey || teaser.Tags.GetFirst([]string{"teaser"}) == nil {
+		t.Fatalf("expected a teaser, got %v", teaser)
+	}
+	if got := reader.receive("live"); got == nil || got.ID != article.ID || got.Content != "" {
+		t.Fatalf("expected the stripped article, got %v", got)
+	}
+
+	// entitled readers still get everything when they ask
+	if got := author.query(nostr.Filter{IDs: []string{note.ID}}); len(got) != 1 || got[0].Content != "secret" {
+		t.Fatalf("the owner should read the note, got %v", got)
+	}
+
+	// what was stored is still whole
+	stored, err := queryAll(context.Background(), db, nostr.Filter{IDs: []string{note.ID, article.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, evt := range stored {
+		if evt.Content == "" || evt.Sig == "" {
+			t.Errorf("stored event %s was stripped", evt.ID)
+		}
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected both events stored, got %d", len(stored))
+	}
+}
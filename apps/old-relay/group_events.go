@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/maps"
+)
+
+// The NIP-29 metadata (39000), admins (39001) and members (39002) of a group
+// are signed by the relay only when the state they describe changes. They are
+// stored like any other replaceable event, broadcast to open subscriptions and
+// kept in memory, so every query for the same state gets the same event back.
+//
+// The stored members list has no "h" tag: it describes the group, it doesn't
+// change it, so it is never replayed as a moderation action.
+
+var groupEventKinds = []int{39000, 39001, 39002}
+
+// groupEvents caches the current relay-signed events, keyed by groupEventKey
+var groupEvents sync.Map
+
+// serializes the regeneration of the events
+var groupEventsMutex sync.Mutex
+
+func groupEventKey(kind int, groupId string) string {
+	return strconv.Itoa(kind) + ":" + groupId
+}
+
+// getGroupEvent returns the current relay-signed event of the given kind for a
+// group, generating it the first time it is asked for.
+func getGroupEvent(ctx context.Context, groupId string, kind int) *nostr.Event {
+	if evt, ok := groupEvents.Load(groupEventKey(kind, groupId)); ok {
+		return evt.(*nostr.Event)
+	}
+	if err := refreshGroupEvents(ctx, groupId, kind); err != nil {
+		log.Error().Err(err).Str("group", groupId).Int("kind", kind).Msg("failed to generate group event")
+		return nil
+	}
+	if evt, ok := groupEvents.Load(groupEventKey(kind, groupId)); ok {
+		return evt.(*nostr.Event)
+	}
+	return nil
+}
+
+// refreshGroupEvents regenerates the given kinds (all of them if none is given)
+// for a group and publishes the ones whose content changed.
+func refreshGroupEvents(ctx context.Context, groupId string, kinds ...int) error {
+	if len(kinds) == 0 {
+		kinds = groupEventKinds
+	}
+
+	// the snapshot is taken with the lock held, otherwise a refresh for an older
+	// state could publish after one for a newer state
+	groupEventsMutex.Lock()
+	defer groupEventsMutex.Unlock()
+
+	group := groups.Snapshot(ctx, groupId, false)
+	if group == nil {
+		return nil
+	}
+
+	for _, kind := range kinds {
+		evt, err := buildGroupEvent(group, kind)
+		if err != nil {
+			return err
+		}
+
+		previous := loadGroupEvent(ctx, kind, groupId)
+		if previous != nil && previous.Content == evt.Content && sameTags(previous.Tags, evt.Tags) {
+			groupEvents.Store(groupEventKey(kind, groupId), previous)
+			continue
+		}
+
+		// replaceable events are told apart by their timestamp, so never reuse one
+		evt.CreatedAt = nostr.Now()
+		if previous != nil && evt.CreatedAt <= previous.CreatedAt {
+			evt.CreatedAt = previous.CreatedAt + 1
+		}
+		if err := evt.Sign(s.RelayPrivkey); err != nil {
+			return err
+		}
+		if err := storeGroupEvent(ctx, evt); err != nil {
+			return fmt.Errorf("failed to store kind %d: %w", kind, err)
+		}
+
+		groupEvents.Store(groupEventKey(kind, groupId), evt)
+		relay.BroadcastEvent(evt)
+	}
+
+	return nil
+}
+
+func buildGroupEvent(group *Group, kind int) (*nostr.Event, error) {
+	switch kind {
+	case 39000:
+		return groupMetadataEvent(group), nil
+	case 39001:
+		return groupAdminsEvent(group), nil
+	case 39002:
+		paid, err := loadPaidMemberships(group.ID)
+		if err != nil {
+			return nil, err
+		}
+		return groupMembersEvent(group, paid), nil
+	default:
+		return nil, fmt.Errorf("kind %d is not a group event", kind)
+	}
+}
+
+// loadGroupEvent finds the current relay-signed event of a group, from the
+// cache or from the database
+func loadGroupEvent(ctx context.Context, kind int, groupId string) *nostr.Event {
+	if evt, ok := groupEvents.Load(groupEventKey(kind, groupId)); ok {
+		return evt.(*nostr.Event)
+	}
+
+	ch, err := db.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{kind},
+		Authors: []string{s.RelayPubkey},
+		Tags:    nostr.TagMap{"d": []string{groupId}},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("group", groupId).Int("kind", kind).Msg("failed to load group event")
+		return nil
+	}
+
+	var latest *nostr.Event
+	for evt := range ch {
+		if latest == nil || evt.CreatedAt > latest.CreatedAt {
+			latest = evt
+		}
+	}
+	return latest
+}
+
+// storeGroupEvent saves evt in place of the previous versions. We don't go
+// through relay.AddEvent since these events are derived from the state and
+// must not be policed or acted upon like the ones clients send.
+func storeGroupEvent(ctx context.Context, evt *nostr.Event) error {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{evt.Kind},
+		Authors: []string{evt.PubKey},
+		Tags:    nostr.TagMap{"d": []string{getGroupIdFromEvent(evt, "d")}},
+	})
+	if err != nil {
+		return err
+	}
+	var previous []*nostr.Event
+	for old := range ch {
+		previous = append(previous, old)
+	}
+	for _, old := range previous {
+		if err := deleteEvent(ctx, old); err != nil {
+			return err
+		}
+	}
+
+	if err := db.SaveEvent(ctx, evt); err != nil {
+		return err
+	}
+	indexVisibility(ctx, evt)
+	return nil
+}
+
+func sameTags(a nostr.Tags, b nostr.Tags) bool {
+	return slices.EqualFunc(a, b, func(x nostr.Tag, y nostr.Tag) bool {
+		return slices.Equal(x, y)
+	})
+}
+
+func groupMetadataEvent(group *Group) *nostr.Event {
+	evt := &nostr.Event{
+		Kind:    39000,
+		Content: group.About,
+		Tags: nostr.Tags{
+			nostr.Tag{"d", group.ID},
+		},
+	}
+	if group.Name != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"name", group.Name})
+	}
+	if group.Picture != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"picture", group.Picture})
+	}
+
+	// status
+	if group.Private {
+		evt.Tags = append(evt.Tags, nostr.Tag{"private"})
+	} else {
+		evt.Tags = append(evt.Tags, nostr.Tag{"public"})
+	}
+	if group.Closed {
+		evt.Tags = append(evt.Tags, nostr.Tag{"closed"})
+	} else {
+		evt.Tags = append(evt.Tags, nostr.Tag{"open"})
+	}
+
+	if group.RateLimit.Events > 0 {
+		evt.Tags = append(evt.Tags, nostr.Tag{"rate-limit", group.RateLimit.String()})
+	}
+
+	return evt
+}
+
+// the label used for admins whose role was built only out of permissions
+const defaultAdminRoleName = "admin"
+
+// groupAdminsEvent builds the NIP-29 kind 39001 list of admins, each one tagged
+// as ["p", pubkey, role name]. What each role can do is up to the relay, so
+// permissions aren't listed. The relay itself isn't listed either.
+func groupAdminsEvent(group *Group) *nostr.Event {
+	evt := &nostr.Event{
+		Kind:    39001,
+		Content: "list of admins for group " + group.ID,
+		Tags: nostr.Tags{
+			nostr.Tag{"d", group.ID},
+		},
+	}
+
+	pubkeys := maps.Keys(group.Members)
+	sort.Strings(pubkeys)
+	for _, pubkey := range pubkeys {
+		role := group.Members[pubkey]
+		if role == emptyRole || role == masterRole {
+			continue
+		}
+
+		name := role.Name
+		if name == "" {
+			name = defaultAdminRoleName
+		}
+		evt.Tags = append(evt.Tags, nostr.Tag{"p", pubkey, name})
+	}
+
+	return evt
+}
+
+// groupMembersEvent builds the NIP-29 kind 39002 list of members. Paid
+// memberships are tagged as ["p", pubkey, tier, paid until], which is what
+// loadMemberships reads, everyone else as ["p", pubkey]. Roles are in the 39001.
+func groupMembersEvent(group *Group, paid []PaidMembership) *nostr.Event {
+	evt := &nostr.Event{
+		Kind:    39002,
+		Content: "list of members of " + group.ID,
+		Tags: nostr.Tags{
+			nostr.Tag{"d", group.ID},
+		},
+	}
+
+	tags := make(map[string]nostr.Tag, len(group.Members)+len(paid))
+	for pubkey := range group.Members {
+		if pubkey != s.RelayPubkey {
+			tags[pubkey] = nostr.Tag{"p", pubkey}
+		}
+	}
+	for _, membership := range paid {
+		tags[membership.Pubkey] = nostr.Tag{
+			"p", membership.Pubkey, membership.Tier, strconv.FormatInt(int64(membership.PaidUntil), 10),
+		}
+	}
+
+	pubkeys := maps.Keys(tags)
+	sort.Strings(pubkeys)
+	for _, pubkey := range pubkeys {
+		evt.Tags = append(evt.Tags, tags[pubkey])
+	}
+
+	return evt
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestGroupAdminsEventListsRoleNamesOnly(t *testing.T) {
+	setupTestRelay(t)
+
+	pubkey := func() string {
+		pk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+		return pk
+	}
+	granted, trimmed, demoted, moderator, plain := pubkey(), pubkey(), pubkey(), pubkey(), pubkey()
+
+	group := newGroup("admins")
+	for _, action := range []Action{
+		AddUser{Targets: []string{granted, trimmed, demoted, moderator, plain}},
+		AddPermission{Targets: []string{granted}, Permissions: []Permission{PermAddUser, PermDeleteEvent}},
+		AddPermission{Targets: []string{trimmed}, Permissions: []Permission{PermAddUser, PermEditMetadata}},
+		RemovePermission{Targets: []string{trimmed}, Permissions: []Permission{PermAddUser}},
+		AddPermission{Targets: []string{demoted}, Permissions: []Permission{PermRemoveUser}},
+		RemovePermission{Targets: []string{demoted}, Permissions: []Permission{PermRemoveUser}},
+		EditRole{Name: "moderator", Permissions: []Permission{PermDeleteEvent}},
+		AssignRole{Targets: []string{moderator}, Name: "moderator"},
+		// a named role keeps its name when permissions are added on top of it
+		AddPermission{Targets: []string{moderator}, Permissions: []Permission{PermRemoveUser}},
+	} {
+		action.Apply(group)
+	}
+
+	expected := map[string]string{
+		granted:   defaultAdminRoleName,
+		trimmed:   defaultAdminRoleName,
+		moderator: "moderator",
+	}
+
+	evt := groupAdminsEvent(group)
+	if d := evt.Tags.GetD(); d != group.ID {
+		t.Fatalf("wrong d tag %q", d)
+	}
+	listed := 0
+	for _, tag := range evt.Tags {
+		if tag[0] != "p" {
+			continue
+		}
+		listed++
+		if len(tag) != 3 {
+			t.Errorf("admin tag %v should be [\"p\", pubkey, role]", tag)
+			continue
+		}
+		if role, ok := expected[tag[1]]; !ok {
+			t.Errorf("%s shouldn't be listed as an admin", tag[1])
+		} else if tag[2] != role {
+			t.Errorf("%s listed with role %q, expected %q", tag[1], tag[2], role)
+		}
+	}
+	if listed != len(expected) {
+		t.Errorf("got %d admins, expected %d", listed, len(expected))
+	}
+}
+
+// run with -race: every change refreshes the members list right after it, the
+// last list published must have everyone
+func TestRefreshGroupEventsPublishesLatestState(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	groupId, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+			evt := signEvent(t, s.RelayPrivkey, 9000, nostr.Timestamp(1000+i),
+				nostr.Tags{{"h", groupId}, {"p", member}}, "")
+			saveTestEvent(t, evt)
+			if err := groups.Apply(ctx, evt); err != nil {
+				t.Error(err)
+			}
+			if err := refreshGroupEvents(ctx, groupId, 39002); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cached := getGroupEvent(ctx, groupId, 39002)
+	if cached == nil || len(cached.Tags.GetAll([]string{"p", ""})) != writers {
+		t.Fatalf("latest members list is stale: %v", cached)
+	}
+
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{39002}, Tags: nostr.TagMap{"d": []string{groupId}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []*nostr.Event
+	for evt := range ch {
+		stored = append(stored, evt)
+	}
+	if len(stored) != 1 || stored[0].ID != cached.ID {
+		t.Fatalf("expected only the cached members list to be stored, got %d events", len(stored))
+	}
+}
+
+func TestListingGroupsFindsEveryGroup(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := createGroup(ctx, "created", owner, GroupSetup{Name: "created"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a history from before snapshots were taken
+	saveTestEvent(t, signEvent(t, s.RelayPrivkey, 9003, nostr.Now()-100,
+		nostr.Tags{{"h", "old"}, {"p", owner}, {"permission", PermAddUser}}, ""))
+	saveTestEvent(t, signEvent(t, s.RelayPrivkey, 9006, nostr.Now()-100, nostr.Tags{{"h", "old"}, {"public"}}, ""))
+
+	// a creator who only has a tier
+	creatorSk := nostr.GeneratePrivateKey()
+	creator, _ := nostr.GetPublicKey(creatorSk)
+	saveTestEvent(t, signEvent(t, creatorSk, 37001, nostr.Now(), nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}}, ""))
+
+	if err := backfillSnapshots(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if loadSnapshot("old") == nil {
+		t.Error("group without a snapshot wasn't backfilled")
+	}
+	if loadSnapshot(creator) != nil {
+		t.Error("creator group was snapshotted without a moderation history")
+	}
+
+	ch, err := metadataQueryHandler(ctx, nostr.Filter{Kinds: []int{39000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for evt := range ch {
+		listed[evt.Tags.GetD()] = true
+	}
+	for _, groupId := range []string{"created", "old", creator} {
+		if !listed[groupId] {
+			t.Errorf("group %s wasn't listed: %v", groupId, listed)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// GroupStore keeps the state of every group we have loaded, derived from the
+// moderation events in the database. khatru calls our handlers concurrently, so
+// nothing should touch a *Group's members or metadata directly: readers take a
+// Snapshot and writers go through Apply, which holds that group's lock.
+type GroupStore struct {
+	mu     sync.Mutex
+	groups map[string]*Group
+}
+
+// how long after a group is loaded Apply checks for events the replay applied
+const replayedWindow = time.Minute
+
+func NewGroupStore() *GroupStore {
+	return &GroupStore{groups: make(map[string]*Group)}
+}
+
+// Get returns the live group with the given id, replaying its history from the
+// database the first time it is asked for. It returns nil if the group doesn't
+// exist and createGroup is false.
+//
+// Only the immutable ID and the rate limiter (which is safe for concurrent use)
+// may be used on the returned value, everything else must be read through
+// Snapshot.
+//
+// Groups made up because of createGroup aren't kept until something is applied
+// to them, otherwise any event with a random h tag would grow the store forever.
+func (gs *GroupStore) Get(ctx context.Context, id string, createGroup bool) *Group {
+	return gs.get(ctx, id, createGroup, false)
+}
+
+func (gs *GroupStore) get(ctx context.Context, id string, createGroup bool, keepEmpty bool) *Group {
+	gs.mu.Lock()
+	group, ok := gs.groups[id]
+	gs.mu.Unlock()
+	if ok {
+		return group
+	}
+
+	// replay outside of the store lock so a slow load doesn't block other groups
+	group, changed, exists := loadGroup(ctx, id, createGroup)
+	if group == nil {
+		return nil
+	}
+	if !exists && !keepEmpty {
+		return group
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if existing, ok := gs.groups[id]; ok {
+		// someone else loaded it while we were replaying. Our copy may be older
+		// than theirs by now, so it must not overwrite their snapshot either
+		return existing
+	}
+	if changed {
+		saveSnapshot(group)
+	}
+	gs.groups[id] = group
+	return group
+}
+
+// Snapshot returns a copy of the group's current state that callers can read
+// freely without holding any locks.
+func (gs *GroupStore) Snapshot(ctx context.Context, id string, createGroup bool) *Group {
+	group := gs.Get(ctx, id, createGroup)
+	if group == nil {
+		return nil
+	}
+	return group.Snapshot()
+}
+
+// Apply parses a moderation event and applies it to the group named by its h tag.
+func (gs *GroupStore) Apply(ctx context.Context, event *nostr.Event) error {
+	makeModerationAction, ok := moderationActionFactories[event.Kind]
+	if !ok {
+		return errUnknownModerationAction
+	}
+	action, err := makeModerationAction(event)
+	if err != nil {
+		return err
+	}
+
+	groupId := getGroupIdFromEvent(event, "h")
+	if groupId == "" {
+		return fmt.Errorf("missing group (`h`) tag")
+	}
+
+	group := gs.get(ctx, groupId, true, true)
+	if group == nil {
+		return fmt.Errorf("unknown group '%s'", groupId)
+	}
+
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	// already applied when the group was loaded from the database just now. The
+	// event is saved before we're called, so this only matters for a short while
+	if time.Since(group.replayedAt) < replayedWindow {
+		if _, ok := group.replayed[event.ID]; ok {
+			return nil
+		}
+	} else {
+		group.replayed = nil
+	}
+
+	if !group.isAfterCheckpoint(event) {
+		group.backdated = true
+	}
+	action.Apply(group)
+	group.advanceCheckpoint(event)
+	saveSnapshot(group)
+	return nil
+}
+
+// Snapshot copies the group state under its read lock. Roles are copied too,
+// except for the shared masterRole and emptyRole markers which are never
+// modified and are compared by identity elsewhere.
+func (group *Group) Snapshot() *Group {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+
+	snapshot := &Group{
+		ID:      group.ID,
+		Name:    group.Name,
+		Picture: group.Picture,
+		About:   group.About,
+		Private: group.Private,
+		Closed:  group.Closed,
+		Members: make(map[string]*Role, len(group.Members)),
+		Roles:   make(map[string]*Role, len(group.Roles)),
+
+		RateLimit: group.RateLimit,
+		bucket:    group.bucket,
+	}
+	for pubkey, role := range group.Members {
+		snapshot.Members[pubkey] = role.copy()
+	}
+	for name, role := range group.Roles {
+		snapshot.Roles[name] = role.copy()
+	}
+	return snapshot
+}
+
+func (role *Role) copy() *Role {
+	if role == emptyRole || role == masterRole {
+		return role
+	}
+
+	permissions := make(map[Permission]struct{}, len(role.Permissions))
+	for perm := range role.Permissions {
+		permissions[perm] = struct{}{}
+	}
+	return &Role{Name: role.Name, Permissions: permissions}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// run with -race: moderation events and queries on the same group all at once
+func TestGroupStoreConcurrentApplyAndQueries(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	owner := nostr.GeneratePrivateKey()
+	groupId, _ := nostr.GetPublicKey(owner)
+
+	const writers = 20
+	members := make([]string, writers)
+	for i := range members {
+		members[i], _ = nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	}
+
+	var wg sync.WaitGroup
+	for i, member := range members {
+		wg.Add(1)
+		go func(i int, member string) {
+			defer wg.Done()
+			evt := signEvent(t, s.RelayPrivkey, 9000, nostr.Timestamp(1000+i),
+				nostr.Tags{{"h", groupId}, {"p", member}}, "")
+			saveTestEvent(t, evt)
+			if err := groups.Apply(ctx, evt); err != nil {
+				t.Error(err)
+			}
+		}(i, member)
+	}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if group := groups.Snapshot(ctx, groupId, true); group != nil {
+					_ = len(group.Members)
+					_ = group.can(members[j%writers], PermAddUser)
+				}
+				groups.Get(ctx, groupId, true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	group := groups.Snapshot(ctx, groupId, false)
+	for _, member := range members {
+		if _, ok := group.Members[member]; !ok {
+			t.Errorf("member %s missing after concurrent applies", member)
+		}
+	}
+
+	// and the same state comes back from the snapshot and the history
+	groups = NewGroupStore()
+	reloaded := groups.Snapshot(ctx, groupId, false)
+	if differences := diffGroups(group, reloaded); len(differences) > 0 {
+		t.Errorf("reloaded group differs: %v", differences)
+	}
+}
+
+func TestGroupStoreKeepsOnlyGroupsThatExist(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	// events can name any group, that must not fill the store
+	for i := 0; i < 10; i++ {
+		if group := groups.Get(ctx, nostr.GeneratePrivateKey(), true); group == nil {
+			t.Fatal("expected an empty group to be made up")
+		}
+	}
+	if n := len(groups.groups); n != 0 {
+		t.Fatalf("expected no group to be kept, got %d", n)
+	}
+
+	// once something happens to a group it is kept
+	groupId, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := groups.Apply(ctx, signEvent(t, s.RelayPrivkey, 9000, 1000, nostr.Tags{{"h", groupId}, {"p", member}}, "")); err != nil {
+		t.Fatal(err)
+	}
+	first := groups.Get(ctx, groupId, false)
+	second := groups.Get(ctx, groupId, false)
+	if first == nil || first != second {
+		t.Fatalf("expected the same cached group, got %p and %p", first, second)
+	}
+	if _, ok := groups.Snapshot(ctx, groupId, false).Members[member]; !ok {
+		t.Fatal("the member added to a new group was lost")
+	}
+
+	// and so are creator groups, which only have tiers
+	creatorSk := nostr.GeneratePrivateKey()
+	creator, _ := nostr.GetPublicKey(creatorSk)
+	saveTestEvent(t, signEvent(t, creatorSk, 37001, 1000, nostr.Tags{{"d", "gold"}}, ""))
+	if groups.Get(ctx, creator, false) != groups.Get(ctx, creator, false) {
+		t.Fatal("expected the creator group to be cached")
+	}
+}
+
+func TestGroupStoreApplySkipsBackdatedEventAlreadyReplayed(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	groupId, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	added := signEvent(t, s.RelayPrivkey, 9000, 2000, nostr.Tags{{"h", groupId}, {"p", member}}, "")
+	saveTestEvent(t, added)
+
+	// a removal dated before the add arrives: it is stored first, then applied,
+	// and the load the apply triggers already replays it in the right order
+	removed := signEvent(t, s.RelayPrivkey, 9001, 1000, nostr.Tags{{"h", groupId}, {"p", member}}, "")
+	saveTestEvent(t, removed)
+	if err := groups.Apply(ctx, removed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := groups.Snapshot(ctx, groupId, false).Members[member]; !ok {
+		t.Fatal("backdated removal was applied twice, after the later add")
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
-	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"golang.org/x/time/rate"
 )
@@ -17,12 +23,32 @@ type Group struct {
 	Picture string
 	About   string
 	Members map[string]*Role
+	Roles   map[string]*Role
 	Private bool
 	Closed  bool
 
+	// how fast events can be sent to the group, the relay's default if zero
+	RateLimit RateLimit
+
+	// guards everything above except the ID, see GroupStore
+	mu     sync.RWMutex
 	bucket *rate.Limiter
+
+	// the last moderation event applied, see snapshots.go
+	lastEventID string
+	lastEventAt nostr.Timestamp
+	// set once an event dated before the checkpoint was applied
+	backdated bool
+
+	// the events the replay that loaded the group applied. Apply skips them, as
+	// it may be what triggered the load for an event that was already stored
+	replayed   map[string]struct{}
+	replayedAt time.Time
 }
 
+// Role is either a named permission bundle defined for the group (in which case
+// it is shared by every member it was assigned to and also found in
+// Group.Roles) or a set of permissions given to a single member.
 type Role struct {
 	Name        string
 	Permissions map[Permission]struct{}
@@ -31,6 +57,33 @@ type Role struct {
 type Membership struct {
 	Pubkey string
 	Tier   []string
+
+	// when the tiers stop being paid for, zero if they never do.
+	// access continues for MembershipGracePeriod after that
+	ValidUntil nostr.Timestamp
+}
+
+// isActive tells if the membership still gives access at the given time
+func (membership Membership) isActive(now nostr.Timestamp) bool {
+	if membership.ValidUntil == 0 {
+		return true
+	}
+	return now <= membership.ValidUntil+nostr.Timestamp(s.MembershipGracePeriod.Seconds())
+}
+
+// parseMembershipTag reads a ["p", pubkey, tier, valid until] tag from a kind 39002,
+// everything after the pubkey is optional.
+func parseMembershipTag(tag nostr.Tag) (tier string, validUntil nostr.Timestamp) {
+	tier = "Free"
+	if len(tag) >= 3 && tag[2] != "" {
+		tier = tag[2]
+	}
+	if len(tag) >= 4 {
+		if until, err := strconv.ParseInt(tag[3], 10, 64); err == nil {
+			validUntil = nostr.Timestamp(until)
+		}
+	}
+	return tier, validUntil
 }
 
 type Permission = string
@@ -43,6 +96,7 @@ const (
 	PermAddPermission    Permission = "add-permission"
 	PermRemovePermission Permission = "remove-permission"
 	PermEditGroupStatus  Permission = "edit-group-status"
+	PermEditRoles        Permission = "edit-roles"
 )
 
 var availablePermissions = map[Permission]struct{}{
@@ -53,10 +107,11 @@ var availablePermissions = map[Permission]struct{}{
 	PermAddPermission:    {},
 	PermRemovePermission: {},
 	PermEditGroupStatus:  {},
+	PermEditRoles:        {},
 }
 
 var (
-	groups = make(map[string]*Group)
+	groups = NewGroupStore()
 
 	// used for the default role, the actual relay, hidden otherwise
 	masterRole *Role = &Role{"master", map[Permission]struct{}{
@@ -67,94 +122,267 @@ var (
 		PermAddPermission:    {},
 		PermRemovePermission: {},
 		PermEditGroupStatus:  {},
+		PermEditRoles:        {},
 	}}
 
 	// used for normal members without admin powers, not displayed
 	emptyRole *Role = nil
 )
 
-func createGroup(groupId string, ownerPubkey string, ctx context.Context) string {
-	vrelay := eventstore.RelayWrapper{Store: db}
-	res, _ := vrelay.QuerySync(ctx, nostr.Filter{Tags: nostr.TagMap{"#h": []string{groupId}}, Limit: 1})
-	if len(res) > 0 {
-		return "group already exists"
-	}
-
-	ownerPermissions := &nostr.Event{
-		CreatedAt: nostr.Now(),
-		Kind:      9003,
-		Tags: nostr.Tags{
-			nostr.Tag{"h", groupId},
-			nostr.Tag{"p", ownerPubkey},
-			nostr.Tag{"permission", PermAddUser},
-			nostr.Tag{"permission", PermRemoveUser},
-			nostr.Tag{"permission", PermEditMetadata},
-			nostr.Tag{"permission", PermAddPermission},
-			nostr.Tag{"permission", PermRemovePermission},
-			nostr.Tag{"permission", PermDeleteEvent},
-			nostr.Tag{"permission", PermEditGroupStatus},
+var errGroupExists = errors.New("group already exists")
+
+// GroupSetup is what a creator can set when creating a group
+type GroupSetup struct {
+	Name    string `json:"name"`
+	About   string `json:"about"`
+	Picture string `json:"picture"`
+	Private bool   `json:"private"`
+	Closed  bool   `json:"closed"`
+	// kind 37001 tiers signed by the owner
+	Tiers []*nostr.Event `json:"tiers"`
+}
+
+var (
+	groupIdPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	nonSlugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// newGroupId makes the id of a group being created according to GroupIDScheme:
+// "pubkey" uses the owner's pubkey (a creator group), "random" 8 random bytes
+// and "name" a slug of the group name.
+func newGroupId(ownerPubkey string, setup GroupSetup) (string, error) {
+	switch s.GroupIDScheme {
+	case "pubkey":
+		return ownerPubkey, nil
+	case "random":
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(id), nil
+	case "name":
+		slug := strings.Trim(nonSlugPattern.ReplaceAllString(strings.ToLower(setup.Name), "-"), "-")
+		if len(slug) > 32 {
+			slug = strings.TrimRight(slug[:32], "-")
+		}
+		if !groupIdPattern.MatchString(slug) {
+			return "", fmt.Errorf("a group name with letters or numbers is needed")
+		}
+		return slug, nil
+	default:
+		return "", fmt.Errorf("unknown group id scheme '%s'", s.GroupIDScheme)
+	}
+}
+
+// listGroupIds lists every group there is: the ones with a snapshot, and the
+// groups of creators who have a tier but never had a moderation action applied.
+func listGroupIds(ctx context.Context) ([]string, error) {
+	ids, err := snapshottedGroupIds()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		seen[id] = struct{}{}
+	}
+
+	filter := nostr.Filter{Kinds: []int{37001}}
+	err = pageEvents(ctx, db, filter, db.MaxLimit, func(page []*nostr.Event) error {
+		for _, tier := range page {
+			if _, ok := seen[tier.PubKey]; !ok {
+				seen[tier.PubKey] = struct{}{}
+				ids = append(ids, tier.PubKey)
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// groupExists tells if a group has any moderation history
+func groupExists(ctx context.Context, groupId string) (bool, error) {
+	if loadSnapshot(groupId) != nil {
+		return true, nil
+	}
+	kinds := make([]int, 0, len(moderationActionFactories))
+	for kind := range moderationActionFactories {
+		kinds = append(kinds, kind)
+	}
+	count, err := db.CountEvents(ctx, nostr.Filter{Kinds: kinds, Tags: nostr.TagMap{"h": []string{groupId}}})
+	return count > 0, err
+}
+
+// createGroup gives the owner every permission on a new group and applies the
+// initial metadata and status, all with relay-signed moderation events.
+func createGroup(ctx context.Context, groupId string, ownerPubkey string, setup GroupSetup) error {
+	if exists, err := groupExists(ctx, groupId); err != nil {
+		return err
+	} else if exists {
+		return errGroupExists
+	}
+
+	actions := []*nostr.Event{
+		{
+			Kind: 9003,
+			Tags: nostr.Tags{
+				nostr.Tag{"h", groupId},
+				nostr.Tag{"p", ownerPubkey},
+				nostr.Tag{"permission", PermAddUser},
+				nostr.Tag{"permission", PermRemoveUser},
+				nostr.Tag{"permission", PermEditMetadata},
+				nostr.Tag{"permission", PermAddPermission},
+				nostr.Tag{"permission", PermRemovePermission},
+				nostr.Tag{"permission", PermDeleteEvent},
+				nostr.Tag{"permission", PermEditGroupStatus},
+				nostr.Tag{"permission", PermEditRoles},
+			},
 		},
 	}
 
-	if err := ownerPermissions.Sign(s.RelayPrivkey); err != nil {
-		log.Error().Err(err).Msg("error signing group creation event")
-		return "error signing group creation event: " + err.Error()
+	metadata := &nostr.Event{Kind: 9002, Tags: nostr.Tags{nostr.Tag{"h", groupId}}}
+	for _, tag := range []nostr.Tag{{"name", setup.Name}, {"about", setup.About}, {"picture", setup.Picture}} {
+		if tag[1] != "" {
+			metadata.Tags = append(metadata.Tags, tag)
+		}
+	}
+	if len(metadata.Tags) > 1 {
+		actions = append(actions, metadata)
 	}
 
-	if err := relay.AddEvent(ctx, ownerPermissions); err != nil {
-		log.Error().Err(err).Stringer("event", ownerPermissions).Msg("failed to save group creation event")
-		return "failed to save group creation event"
+	status := &nostr.Event{Kind: 9006, Tags: nostr.Tags{nostr.Tag{"h", groupId}}}
+	if setup.Private {
+		status.Tags = append(status.Tags, nostr.Tag{"private"})
+	} else {
+		status.Tags = append(status.Tags, nostr.Tag{"public"})
+	}
+	if setup.Closed {
+		status.Tags = append(status.Tags, nostr.Tag{"closed"})
+	} else {
+		status.Tags = append(status.Tags, nostr.Tag{"open"})
+	}
+	actions = append(actions, status)
+
+	for _, action := range actions {
+		action.CreatedAt = nostr.Now()
+		if err := action.Sign(s.RelayPrivkey); err != nil {
+			return fmt.Errorf("failed to sign group creation event: %w", err)
+		}
+		if err := relay.AddEvent(ctx, action); err != nil {
+			return fmt.Errorf("failed to save group creation event: %w", err)
+		}
 	}
 
-	return ""
+	log.Info().Str("group", groupId).Str("owner", ownerPubkey).Msg("created group")
+	return nil
 }
 
-// loadGroup loads all the group metadata from all the past action messages
-func loadGroup(ctx context.Context, id string, createGroup bool) *Group {
-	if group, ok := groups[id]; ok {
-		return group
+// rateLimit is the policy the group's bucket follows
+func (group *Group) rateLimit() RateLimit {
+	if group.RateLimit.Events > 0 {
+		return group.RateLimit
 	}
+	return s.RateLimitGroup
+}
 
-	group := &Group{
+func newGroup(id string) *Group {
+	return &Group{
 		ID: id,
 		Members: map[string]*Role{
 			s.RelayPubkey: masterRole,
 		},
+		Roles:  make(map[string]*Role),
+		bucket: s.RateLimitGroup.newLimiter(),
+	}
+}
 
-		// very strict rate limits
-		bucket: rate.NewLimiter(rate.Every(time.Minute*2), 15),
+// loadGroup loads all the group metadata from its last snapshot and all the
+// action messages that came after it, reporting whether the replay changed it
+// so the snapshot should be saved again. It doesn't cache or save anything, use
+// the groups store instead.
+//
+// exists tells if the group has a history or an owner, as opposed to one that
+// was only made up because createGroup was set.
+func loadGroup(ctx context.Context, id string, createGroup bool) (group *Group, changed bool, exists bool) {
+	if snapshot := loadSnapshot(id); snapshot != nil {
+		group = snapshot.restore()
+		applied, err := replayGroup(ctx, group)
+		if err != nil {
+			log.Error().Err(err).Str("group", id).Msg("failed to load moderation history since snapshot")
+		}
+		return group, applied > 0, true
 	}
-	ch, _ := db.QueryEvents(ctx, nostr.Filter{
-		Limit: 5000, Kinds: maps.Keys(moderationActionFactories), Tags: nostr.TagMap{"h": []string{id}},
-	})
 
-	events := make([]*nostr.Event, 0, 5000)
-	for event := range ch {
-		events = append(events, event)
-	}
-	if len(events) == 0 {
-		if !createGroup {
-			// Check if we have a kind:37001 event for this pubkey
-			// If we don't and createGroup is false return nil
-			existingEvents, _ := db.CountEvents(ctx, nostr.Filter{
-				Kinds: []int{37001}, Authors: []string{id},
-			})
-			if existingEvents == 0 {
-				return nil
+	group = newGroup(id)
+	applied, err := replayGroup(ctx, group)
+	if err != nil {
+		log.Error().Err(err).Str("group", id).Msg("failed to load moderation history")
+	}
+
+	if applied == 0 {
+		// Check if we have a kind:37001 event for this pubkey
+		// If we don't and createGroup is false return nil
+		existingEvents, _ := db.CountEvents(ctx, nostr.Filter{
+			Kinds: []int{37001}, Authors: []string{id},
+		})
+		if existingEvents == 0 {
+			if !createGroup {
+				return nil, false, false
 			}
+			return group, false, false
 		}
 
 		// create group here
-		return group
+		return group, false, true
+	}
+
+	return group, true, true
+}
+
+// replayGroup applies the moderation history that comes after the group's
+// checkpoint, returning how many events were processed.
+func replayGroup(ctx context.Context, group *Group) (applied int, err error) {
+	replayer := Replayer{Store: db}
+	history, err := replayer.History(ctx, group.ID, group.lastEventAt)
+	if err != nil {
+		return 0, err
+	}
+
+	events := make([]*nostr.Event, 0, len(history))
+	for _, event := range history {
+		if group.isAfterCheckpoint(event) {
+			events = append(events, event)
+		}
 	}
-	for i := len(events) - 1; i >= 0; i-- {
-		evt := events[i]
-		act, _ := moderationActionFactories[evt.Kind](evt)
-		act.Apply(group)
+
+	if group.replayed == nil {
+		group.replayed = make(map[string]struct{}, len(events))
 	}
+	for _, event := range events {
+		group.replayed[event.ID] = struct{}{}
+	}
+	group.replayedAt = time.Now()
+
+	for _, failure := range replayer.Replay(group, events) {
+		log.Warn().Err(failure.Err).Str("group", group.ID).Stringer("event", failure.Event).
+			Msg("skipping unparseable moderation event")
+	}
+
+	return len(events), nil
+}
 
-	groups[id] = group
-	return group
+// can tells if pubkey is allowed to do things that require perm in this group.
+// The owner of a creator group (whose id is their pubkey) can do anything.
+// Call it on a snapshot, it doesn't lock.
+func (group *Group) can(pubkey string, perm Permission) bool {
+	if pubkey == group.ID || pubkey == s.RelayPubkey {
+		return true
+	}
+	role, ok := group.Members[pubkey]
+	if !ok || role == emptyRole {
+		return false
+	}
+	_, ok = role.Permissions[perm]
+	return ok
 }
 
 func loadGroupMemberships(ctx context.Context, groupId string) []Membership {
@@ -165,8 +393,9 @@ func loadGroupMemberships(ctx context.Context, groupId string) []Membership {
 
 	for event := range ch {
 		for _, tag := range event.Tags {
-			if tag[0] == "p" {
-				memberships = append(memberships, Membership{tag[1], tag[2:]})
+			if len(tag) >= 2 && tag[0] == "p" {
+				tier, validUntil := parseMembershipTag(tag)
+				memberships = append(memberships, Membership{tag[1], []string{tier}, validUntil})
 			}
 		}
 	}
@@ -174,6 +403,13 @@ func loadGroupMemberships(ctx context.Context, groupId string) []Membership {
 	return memberships
 }
 
+// isTrustedMembershipList tells if a kind 39002 comes from someone allowed to
+// grant memberships: the relay, which derives them from verified payments, or
+// the owner of the group.
+func isTrustedMembershipList(event *nostr.Event, groupId string) bool {
+	return event.PubKey == s.RelayPubkey || event.PubKey == groupId
+}
+
 func loadMemberships(ctx context.Context, userPubkey string) []Membership {
 	ch, _ := db.QueryEvents(ctx, nostr.Filter{
 		Kinds: []int{39002},
@@ -183,28 +419,21 @@ func loadMemberships(ctx context.Context, userPubkey string) []Membership {
 	memberships := make([]Membership, 0, len(ch))
 
 	for event := range ch {
-		var tierName *string
-
 		groupId := getGroupIdFromEvent(event, "d")
-		if groupId == "" {
+		if groupId == "" || !isTrustedMembershipList(event, groupId) {
 			continue
 		}
 		for _, tag := range event.Tags {
-			// fmt.Println("tag", tag, "userPubkey", userPubkey)
-			if tag[0] == "p" && tag[1] == userPubkey {
-				if len(tag) >= 3 {
-					tierName = &tag[2]
-				} else {
-					tier := "Free"
-					tierName = &tier
-				}
+			if len(tag) >= 2 && tag[0] == "p" && tag[1] == userPubkey {
+				tierName, validUntil := parseMembershipTag(tag)
 
-				// add to memberships, if there is already a membership with this group, add the tier if it's new
+				// add to memberships, if there is already a membership with this group
+				// valid for the same time, add the tier if it's new
 				added := false
 				for i, membership := range memberships {
-					if membership.Pubkey == groupId {
-						if !slices.Contains(membership.Tier, *tierName) {
-							memberships[i].Tier = append(membership.Tier, *tierName)
+					if membership.Pubkey == groupId && membership.ValidUntil == validUntil {
+						if !slices.Contains(membership.Tier, tierName) {
+							memberships[i].Tier = append(membership.Tier, tierName)
 						}
 
 						added = true
@@ -213,7 +442,7 @@ func loadMemberships(ctx context.Context, userPubkey string) []Membership {
 
 				// if no membership was found, add a new one
 				if !added {
-					memberships = append(memberships, Membership{groupId, []string{*tierName}})
+					memberships = append(memberships, Membership{groupId, []string{tierName}, validUntil})
 				}
 			}
 		}
@@ -222,37 +451,11 @@ func loadMemberships(ctx context.Context, userPubkey string) []Membership {
 	return memberships
 }
 
-/**
- * Gets the tiers a pubkey has on a group.
- */
-func getTiersForPubkeyOnGroup(ctx context.Context, userPubkey string, groupId string) []string {
-	ch, _ := db.QueryEvents(ctx, nostr.Filter{
-		Kinds: []int{39002},
-		Tags:  nostr.TagMap{"p": []string{userPubkey}},
-	})
-
-	tiers := make([]string, 0, len(ch))
-
-	for event := range ch {
-		for _, tag := range event.Tags {
-			if tag[0] == "p" && tag[1] == userPubkey {
-				if len(tag) >= 3 {
-					tiers = append(tiers, tag[2])
-				} else {
-					tiers = append(tiers, "Free")
-				}
-			}
-		}
-	}
-
-	return tiers
-}
-
-func getTiersFromMemberships(memberships []Membership, groupId string) []string {
+func getTiersFromMemberships(memberships []Membership, groupId string, now nostr.Timestamp) []string {
 	tiers := make([]string, 0, len(memberships))
 
 	for _, membership := range memberships {
-		if membership.Pubkey == groupId {
+		if membership.Pubkey == groupId && membership.isActive(now) {
 			tiers = append(tiers, membership.Tier...)
 		}
 	}
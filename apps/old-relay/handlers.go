@@ -1,36 +1,140 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/theplant/htmlgo"
 )
 
+// handleRoot serves the NIP-86 management API and the homepage, which share the
+// relay url.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if isManagementRequest(r) {
+		handleManagement(w, r)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	handleHomepage(w, r)
+}
+
 func handleHomepage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	htmlgo.Fprint(w, homepageHTML(), r.Context())
 }
 
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// handleCreateGroup creates a group owned by whoever signed the NIP-98
+// authorization of the request, whose body is a GroupSetup.
+//
+// The tiers are saved before the group is created, so a tier the relay refuses
+// leaves nothing behind, and a request that failed halfway can be retried:
+// they're the owner's own events, which don't depend on the group, and saving
+// them again changes nothing.
 func handleCreateGroup(w http.ResponseWriter, r *http.Request) {
-	pubkey := r.PostFormValue("pubkey")
-	if pfx, value, err := nip19.Decode(pubkey); err == nil && pfx == "npub" {
-		pubkey = value.(string)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "failed to read request")
+		return
+	}
+
+	owner, err := validateNIP98(r, body)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if hasEntry("banned-pubkeys", owner) {
+		writeJSONError(w, http.StatusForbidden, "pubkey is banned")
+		return
 	}
 
-	// id := make([]byte, 8)
-	// binary.LittleEndian.PutUint64(id, uint64(time.Now().Unix()))
-	// groupId := hex.EncodeToString(id[0:4])
+	var setup GroupSetup
+	if err := json.Unmarshal(body, &setup); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid group setup")
+		return
+	}
+	for _, tier := range setup.Tiers {
+		if msg := checkSetupTier(tier, owner); msg != "" {
+			writeJSONError(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
 
-	log.Info().Str("id", pubkey).Str("owner", pubkey).Msg("making group")
+	groupId, err := newGroupId(owner, setup)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	res := createGroup(pubkey, pubkey, r.Context())
+	if exists, err := groupExists(r.Context(), groupId); err != nil {
+		log.Error().Err(err).Str("group", groupId).Msg("failed to check group")
+		writeJSONError(w, http.StatusInternalServerError, "failed to create group")
+		return
+	} else if exists {
+		writeJSONError(w, http.StatusConflict, errGroupExists.Error())
+		return
+	}
 
-	if res == "" {
-	} else {
-		http.Error(w, res, 403)
+	for _, tier := range setup.Tiers {
+		if err := relay.AddEvent(r.Context(), tier); err != nil {
+			log.Warn().Err(err).Str("group", groupId).Str("tier", tier.ID).Msg("failed to save tier")
+			writeJSONError(w, http.StatusBadRequest, "failed to save tier: "+err.Error())
+			return
+		}
 	}
 
-	naddr, _ := nip19.EncodeEntity(s.RelayPubkey, 39000, pubkey, []string{"wss://" + s.Domain})
-	fmt.Fprintf(w, "group created!\n\n%s", naddr)
+	if err := createGroup(r.Context(), groupId, owner, setup); errors.Is(err, errGroupExists) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("group", groupId).Str("owner", owner).Msg("failed to create group")
+		writeJSONError(w, http.StatusInternalServerError, "failed to create group")
+		return
+	}
+
+	naddr, _ := nip19.EncodeEntity(s.RelayPubkey, 39000, groupId, []string{"wss://" + s.Domain})
+	writeJSON(w, http.StatusCreated, map[string]string{"id": groupId, "naddr": naddr})
+}
+
+// checkSetupTier returns why a tier sent along with a group setup can't be used
+func checkSetupTier(tier *nostr.Event, owner string) string {
+	if tier == nil || tier.Kind != 37001 {
+		return "tiers must be kind 37001 events"
+	}
+	if tier.PubKey != owner {
+		return "tiers must be signed by the group owner"
+	}
+	if ok, err := tier.CheckSignature(); err != nil || !ok {
+		return "tier has an invalid signature"
+	}
+	parsed, err := parseTier(tier)
+	if err != nil {
+		return err.Error()
+	}
+	if len(parsed.Amounts) == 0 {
+		return "tier '" + parsed.ID + "' has no valid amount"
+	}
+	return ""
 }
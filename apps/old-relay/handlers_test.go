@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const createURL = "https://relay.example.com/create"
+
+func postCreate(t *testing.T, r *http.Request) (status int, response map[string]string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handleCreateGroup(w, r)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func setupBody(t *testing.T, setup GroupSetup) string {
+	body, err := json.Marshal(setup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCreateGroup(t *testing.T) {
+	startTestRelay(t)
+	ctx := context.Background()
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	tier := signEvent(t, ownerSk, 37001, nostr.Now(), nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}}, "")
+	body := setupBody(t, GroupSetup{Name: "Mine", Tiers: []*nostr.Event{tier}})
+
+	status, response := postCreate(t, nip98Request(t, ownerSk, "POST", createURL, body))
+	if status != http.StatusCreated || response["id"] != owner || response["naddr"] == "" {
+		t.Fatalf("got %d %v", status, response)
+	}
+	if group := groups.Snapshot(ctx, owner, false); group == nil || group.Name != "Mine" || !group.can(owner, PermAddUser) {
+		t.Fatalf("group wasn't created as asked: %+v", group)
+	}
+	if _, err := loadTier(ctx, owner, "gold"); err != nil {
+		t.Fatalf("tier wasn't saved: %v", err)
+	}
+
+	// the id is taken now
+	status, response = postCreate(t, nip98Request(t, ownerSk, "POST", createURL, setupBody(t, GroupSetup{Name: "Again"})))
+	if status != http.StatusConflict {
+		t.Fatalf("creating the group twice: got %d %v", status, response)
+	}
+}
+
+func TestCreateGroupAuthorization(t *testing.T) {
+	startTestRelay(t)
+
+	ownerSk := nostr.GeneratePrivateKey()
+	body := setupBody(t, GroupSetup{Name: "Mine"})
+
+	unsigned := httptest.NewRequest("POST", createURL, nil)
+	if status, response := postCreate(t, unsigned); status != http.StatusUnauthorized {
+		t.Errorf("without authorization: got %d %v", status, response)
+	}
+
+	// authorized for another body
+	r := nip98Request(t, ownerSk, "POST", createURL, setupBody(t, GroupSetup{Name: "Other"}))
+	r.Body = io.NopCloser(strings.NewReader(body))
+	if status, response := postCreate(t, r); status != http.StatusUnauthorized {
+		t.Errorf("authorized for another body: got %d %v", status, response)
+	}
+
+	// authorized for another url
+	r = nip98Request(t, ownerSk, "POST", "https://relay.example.com/", body)
+	r.URL.Path = "/create"
+	if status, response := postCreate(t, r); status != http.StatusUnauthorized {
+		t.Errorf("authorized for another url: got %d %v", status, response)
+	}
+}
+
+func TestCreateGroupWithBadSetup(t *testing.T) {
+	startTestRelay(t)
+	ctx := context.Background()
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	otherSk := nostr.GeneratePrivateKey()
+
+	for name, body := range map[string]string{
+		"not json":       "{",
+		"not a tier":     setupBody(t, GroupSetup{Tiers: []*nostr.Event{signEvent(t, ownerSk, 1, nostr.Now(), nil, "")}}),
+		"someone else's": setupBody(t, GroupSetup{Tiers: []*nostr.Event{signEvent(t, otherSk, 37001, nostr.Now(), nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}}, "")}}),
+		"no amount":      setupBody(t, GroupSetup{Tiers: []*nostr.Event{signEvent(t, ownerSk, 37001, nostr.Now(), nostr.Tags{{"d", "gold"}}, "")}}),
+		// passes our checks, but not the relay's
+		"refused by the relay": setupBody(t, GroupSetup{Tiers: []*nostr.Event{signEvent(t, ownerSk, 37001, nostr.Now(), nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}, {relayEncryptedTag}}, "")}}),
+	} {
+		status, response := postCreate(t, nip98Request(t, ownerSk, "POST", createURL, body))
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: got %d %v", name, status, response)
+		}
+	}
+
+	if exists, err := groupExists(ctx, owner); err != nil || exists {
+		t.Fatalf("a group was created from a bad setup: %v", err)
+	}
+
+	// nothing stands in the way of trying again
+	body := setupBody(t, GroupSetup{Tiers: []*nostr.Event{signEvent(t, ownerSk, 37001, nostr.Now(), nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}}, "")}})
+	if status, response := postCreate(t, nip98Request(t, ownerSk, "POST", createURL, body)); status != http.StatusCreated {
+		t.Fatalf("got %d %v", status, response)
+	}
+}
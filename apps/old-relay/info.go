@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/rs/cors"
+)
+
+// supportedNIPs are the NIPs we implement, on top of the ones khatru does on
+// its own. Proof of work and encrypted gated content only count when they are
+// turned on.
+func supportedNIPs() []int {
+	nips := []int{9, 29, 42, 57, 61, 86, 88, 98}
+	if requiresProofOfWork() {
+		nips = append(nips, 13)
+	}
+	if s.EncryptGatedContent {
+		nips = append(nips, 44)
+	}
+	return nips
+}
+
+// RelayInformation is the NIP-11 document with the fields go-nostr doesn't
+// know about yet. Outer fields take the place of the embedded ones.
+type RelayInformation struct {
+	nip11.RelayInformationDocument
+	Limitation *RelayLimitation  `json:"limitation,omitempty"`
+	Retention  []RetentionPolicy `json:"retention,omitempty"`
+}
+
+// RelayLimitation adds what can't be said with a single number. Proof of work
+// is advertised per kind and per group in min_pow_difficulties, on top of the
+// default in min_pow_difficulty.
+type RelayLimitation struct {
+	nip11.RelayLimitationDocument
+	RateLimits      map[string]string `json:"rate_limits,omitempty"`
+	PowDifficulties map[string]int    `json:"min_pow_difficulties,omitempty"`
+}
+
+// RetentionPolicy kinds are single kinds or [from, to] ranges
+type RetentionPolicy struct {
+	Kinds []any `json:"kinds,omitempty"`
+	Time  *int  `json:"time,omitempty"`
+	Count *int  `json:"count,omitempty"`
+}
+
+// initRelayInfo fills relay.Info from the settings and from what the relay
+// does. Fields changed through the management API are loaded afterwards.
+func initRelayInfo() error {
+	relay.Info.Name = s.RelayName
+	relay.Info.PubKey = s.RelayPubkey
+	relay.Info.Description = s.RelayDescription
+	relay.Info.Contact = s.RelayContact
+	relay.Info.Icon = s.RelayIcon
+	relay.Info.Software = s.RelaySoftware
+	relay.Info.Version = relayVersion()
+	relay.Info.PostingPolicy = s.PostingPolicy
+	relay.Info.PaymentsURL = s.PaymentsUrl
+	for _, nip := range supportedNIPs() {
+		relay.Info.AddSupportedNIP(nip)
+	}
+
+	relay.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxLimit:         db.MaxLimit,
+		MaxEventTags:     s.MaxIndexableTags,
+		MinPowDifficulty: s.PowDifficulty,
+		// only gated content needs AUTH
+		AuthRequired: false,
+		// tiers are paid per group, not to get in
+		PaymentRequired: false,
+		// only members can write to groups
+		RestrictedWrites: true,
+	}
+
+	if s.RelayFees != "" {
+		var fees nip11.RelayFeesDocument
+		if err := json.Unmarshal([]byte(s.RelayFees), &fees); err != nil {
+			return fmt.Errorf("invalid RELAY_FEES: %w", err)
+		}
+		relay.Info.Fees = &fees
+	}
+
+	return nil
+}
+
+// relayVersion is the one from the settings or else the commit we were built from
+func relayVersion() string {
+	if s.RelayVersion != "" {
+		return s.RelayVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+	}
+	return "n/a"
+}
+
+// guards relay.Info, which operators can change while it's being served
+var relayInfoMutex sync.RWMutex
+
+func relayInformation() RelayInformation {
+	relayInfoMutex.RLock()
+	info := RelayInformation{RelayInformationDocument: *relay.Info}
+	relayInfoMutex.RUnlock()
+
+	if info.RelayInformationDocument.Limitation != nil {
+		info.Limitation = &RelayLimitation{
+			RelayLimitationDocument: *info.RelayInformationDocument.Limitation,
+			RateLimits:              make(map[string]string),
+		}
+		limits := map[string]RateLimit{
+			"connection": s.RateLimitConnection,
+			"ip":         s.RateLimitIP,
+			"pubkey":     s.RateLimitPubkey,
+			"group":      s.RateLimitGroup,
+		}
+		for kind, limit := range s.RateLimitByKind {
+			limits["kind:"+strconv.Itoa(kind)] = limit
+		}
+		for name, limit := range limits {
+			if limit.Events > 0 {
+				info.Limitation.RateLimits[name] = limit.String()
+			}
+		}
+
+		// a group setting replaces the default and a kind setting can only raise it
+		info.Limitation.PowDifficulties = make(map[string]int)
+		for kind, difficulty := range s.PowDifficultyByKind {
+			info.Limitation.PowDifficulties["kind:"+strconv.Itoa(kind)] = difficulty
+		}
+		for groupId, difficulty := range s.PowDifficultyByGroup {
+			info.Limitation.PowDifficulties["group:"+groupId] = difficulty
+		}
+	}
+
+	// ephemeral events are never stored
+	none := 0
+	info.Retention = []RetentionPolicy{
+		{Kinds: []any{[]int{20000, 29999}}, Time: &none},
+	}
+
+	return info
+}
+
+// serveRelayInformation answers NIP-11 requests with our own document and
+// leaves everything else to next.
+func serveRelayInformation(next http.Handler) http.Handler {
+	nip11Handler := cors.AllowAll().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/nostr+json")
+		json.NewEncoder(w).Encode(relayInformation())
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" && r.Header.Get("Accept") == "application/nostr+json" {
+			nip11Handler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"golang.org/x/exp/slices"
+)
+
+func TestSupportedNIPsFollowSettings(t *testing.T) {
+	setupTestRelay(t)
+
+	for _, v := range []struct {
+		name     string
+		settings func()
+		pow      bool
+		nip44    bool
+	}{
+		{"defaults", func() {}, false, false},
+		{"zero difficulties", func() {
+			s.PowDifficultyByKind = map[int]int{9021: 0}
+			s.PowDifficultyByGroup = map[string]int{"quiet": 0}
+		}, false, false},
+		{"default difficulty", func() { s.PowDifficulty = 8 }, true, false},
+		{"difficulty for a kind", func() { s.PowDifficultyByKind = map[int]int{9021: 20} }, true, false},
+		{"difficulty for a group", func() { s.PowDifficultyByGroup = map[string]int{"busy": 12} }, true, false},
+		{"encrypted gated content", func() { s.EncryptGatedContent = true }, false, true},
+	} {
+		s.PowDifficulty = 0
+		s.PowDifficultyByKind = nil
+		s.PowDifficultyByGroup = nil
+		s.EncryptGatedContent = false
+		v.settings()
+
+		relay = khatru.NewRelay()
+		if err := initRelayInfo(); err != nil {
+			t.Fatal(err)
+		}
+		nips := relayInformation().SupportedNIPs
+		if slices.Contains(nips, 13) != v.pow {
+			t.Errorf("%s: NIP-13 advertised is %v in %v", v.name, !v.pow, nips)
+		}
+		if slices.Contains(nips, 44) != v.nip44 {
+			t.Errorf("%s: NIP-44 advertised is %v in %v", v.name, !v.nip44, nips)
+		}
+		if !slices.Contains(nips, 29) {
+			t.Errorf("%s: NIP-29 isn't advertised in %v", v.name, nips)
+		}
+	}
+}
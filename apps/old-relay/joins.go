@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Join requests (kind 9021) to open groups are approved right away, as are the
+// ones carrying a "code" tag with an invite code the group handed out (kind
+// 9009, only shown to admins). Each code can be used once. Requests to closed
+// groups wait in a queue until an admin with the add-user permission approves
+// them (kind 9013, or just adds the user with a 9000) or rejects them (kind
+// 9014, with the reason as content). Pending requests are only shown to those
+// admins and to whoever made them.
+
+type JoinRequest struct {
+	Group  string          `json:"group"`
+	Pubkey string          `json:"pubkey"`
+	Event  string          `json:"event"`
+	At     nostr.Timestamp `json:"at"`
+}
+
+type InviteCode struct {
+	Group string          `json:"group"`
+	Code  string          `json:"code"`
+	By    string          `json:"by"`
+	At    nostr.Timestamp `json:"at"`
+}
+
+// serializes changes to the join request queues
+var joinRequestsMutex sync.Mutex
+
+func joinRequestKey(groupId string, pubkey string) string {
+	return groupId + ":" + pubkey
+}
+
+func isPendingJoinRequest(event *nostr.Event) bool {
+	var request JoinRequest
+	found, err := state.Get("join-requests", joinRequestKey(getGroupIdFromEvent(event, "h"), event.PubKey), &request)
+	if err != nil {
+		log.Error().Err(err).Str("event", event.ID).Msg("failed to load join request")
+	}
+	return found && request.Event == event.ID
+}
+
+// useInviteCode tells if code is a valid invite code for the group and spends
+// it, so each code lets only one person in.
+func useInviteCode(groupId string, code string) bool {
+	if code == "" {
+		return false
+	}
+
+	joinRequestsMutex.Lock()
+	defer joinRequestsMutex.Unlock()
+
+	key := groupId + ":" + code
+	found, err := state.Get("invite-codes", key, new(InviteCode))
+	if err != nil {
+		log.Error().Err(err).Str("group", groupId).Msg("failed to check invite code")
+		return false
+	}
+	if !found {
+		return false
+	}
+	if err := state.Delete("invite-codes", key); err != nil {
+		log.Error().Err(err).Str("group", groupId).Msg("failed to spend invite code")
+		return false
+	}
+	return true
+}
+
+// canSeeInvite tells if requester may see a kind 9009, whose codes let people
+// into the group: only admins who can add users themselves may.
+func canSeeInvite(group *Group, requester string) bool {
+	return requester != "" && group != nil && group.can(requester, PermAddUser)
+}
+
+// canSeeJoinRequest tells if requester may see a kind 9021 of the given group.
+// Approved or rejected requests are only shown to their author.
+func canSeeJoinRequest(group *Group, requester string, event *nostr.Event) bool {
+	if requester == "" {
+		return false
+	}
+	if requester == event.PubKey {
+		return true
+	}
+	return group != nil && group.can(requester, PermAddUser) && isPendingJoinRequest(event)
+}
+
+func reactToJoinRequest(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 9021 {
+		return
+	}
+	groupId := getGroupIdFromEvent(event, "h")
+	if groupId == "" {
+		return
+	}
+	group := groups.Snapshot(ctx, groupId, true)
+
+	if _, isMember := group.Members[event.PubKey]; isMember {
+		return
+	}
+
+	var code string
+	if tag := event.Tags.GetFirst([]string{"code", ""}); tag != nil {
+		code = (*tag)[1]
+	}
+
+	if !group.Closed || useInviteCode(groupId, code) {
+		// immediately add the requester
+		addUser := &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      9000,
+			Tags: nostr.Tags{
+				nostr.Tag{"h", groupId},
+				nostr.Tag{"p", event.PubKey},
+			},
+		}
+		if err := addUser.Sign(s.RelayPrivkey); err != nil {
+			log.Error().Err(err).Msg("failed to sign add-user event")
+			return
+		}
+		if err := relay.AddEvent(ctx, addUser); err != nil {
+			log.Error().Err(err).Msg("failed to add user who requested to join")
+		}
+		return
+	}
+
+	joinRequestsMutex.Lock()
+	defer joinRequestsMutex.Unlock()
+
+	request := JoinRequest{Group: groupId, Pubkey: event.PubKey, Event: event.ID, At: event.CreatedAt}
+	if err := state.Put("join-requests", joinRequestKey(groupId, event.PubKey), request); err != nil {
+		log.Error().Err(err).Str("group", groupId).Str("pubkey", event.PubKey).Msg("failed to queue join request")
+		return
+	}
+	log.Info().Str("group", groupId).Str("pubkey", event.PubKey).Msg("join request waiting for approval")
+}
+
+// updateJoinRequests takes approved and rejected requests off the queue, lets
+// rejected requesters know and records invite codes.
+func updateJoinRequests(ctx context.Context, event *nostr.Event) {
+	var targets []string
+	var rejection *RejectJoinRequest
+
+	switch event.Kind {
+	case 9000, 9009, 9013, 9014:
+		action, err := moderationActionFactories[event.Kind](event)
+		if err != nil {
+			return
+		}
+		switch a := action.(type) {
+		case *AddUser:
+			targets = a.Targets
+		case *ApproveJoinRequest:
+			targets = a.Targets
+		case *RejectJoinRequest:
+			targets = a.Targets
+			rejection = a
+		case *CreateInvite:
+			recordInviteCodes(event, a)
+			return
+		}
+	default:
+		return
+	}
+
+	groupId := getGroupIdFromEvent(event, "h")
+
+	joinRequestsMutex.Lock()
+	defer joinRequestsMutex.Unlock()
+
+	for _, target := range targets {
+		key := joinRequestKey(groupId, target)
+		if found, err := state.Get("join-requests", key, new(JoinRequest)); err != nil || !found {
+			continue
+		}
+		if err := state.Delete("join-requests", key); err != nil {
+			log.Error().Err(err).Str("group", groupId).Str("pubkey", target).Msg("failed to dequeue join request")
+			continue
+		}
+
+		if rejection != nil {
+			msg := fmt.Sprintf("your request to join %s was rejected", groupId)
+			if rejection.Reason != "" {
+				msg += ": " + rejection.Reason
+			}
+			notifyPubkey(target, msg)
+			log.Info().Str("group", groupId).Str("pubkey", target).Msg("join request rejected")
+		} else {
+			log.Info().Str("group", groupId).Str("pubkey", target).Msg("join request approved")
+		}
+	}
+}
+
+func recordInviteCodes(event *nostr.Event, invite *CreateInvite) {
+	groupId := getGroupIdFromEvent(event, "h")
+	for _, code := range invite.Codes {
+		if err := state.Put("invite-codes", groupId+":"+code, InviteCode{
+			Group: groupId, Code: code, By: event.PubKey, At: event.CreatedAt,
+		}); err != nil {
+			log.Error().Err(err).Str("group", groupId).Msg("failed to record invite code")
+		}
+	}
+}
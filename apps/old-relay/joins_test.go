@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestInvitesAreOnlyForAdminsAndSingleUse(t *testing.T) {
+	relayURL := startTestRelay(t)
+	ctx := context.Background()
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(ctx, owner, owner, GroupSetup{Closed: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	invite := signEvent(t, ownerSk, 9009, nostr.Now(), nostr.Tags{{"h", owner}, {"code", "secret"}}, "")
+	saveTestEvent(t, invite)
+	updateJoinRequests(ctx, invite)
+
+	for name, tc := range map[string]struct {
+		sk       string
+		expected int
+	}{
+		"anonymous": {"", 0},
+		"non-admin": {nostr.GeneratePrivateKey(), 0},
+		"owner":     {ownerSk, 1},
+	} {
+		client := connectTestClient(t, relayURL, tc.sk)
+		if got := len(client.query(nostr.Filter{Kinds: []int{9009}})); got != tc.expected {
+			t.Errorf("%s got %d invites, expected %d", name, got, tc.expected)
+		}
+	}
+
+	if !useInviteCode(owner, "secret") {
+		t.Fatal("invite code wasn't accepted")
+	}
+	if useInviteCode(owner, "secret") {
+		t.Fatal("invite code was accepted twice")
+	}
+	if useInviteCode(owner, "") || useInviteCode(owner, "unknown") {
+		t.Fatal("made up invite code accepted")
+	}
+}
+
+func TestLiveInvitesAndJoinRequestsKeepTheirCodes(t *testing.T) {
+	relayURL := startTestRelay(t)
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(context.Background(), owner, owner, GroupSetup{Closed: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := connectTestClient(t, relayURL, nostr.GeneratePrivateKey())
+	watcher.subscribe("live", nostr.Filter{Kinds: []int{9009, 9021}, Tags: nostr.TagMap{"h": []string{owner}}})
+
+	invite := signEvent(t, ownerSk, 9009, nostr.Now(), nostr.Tags{{"h", owner}, {"code", "secret"}}, "")
+	if ok, reason := connectTestClient(t, relayURL, ownerSk).publish(invite); !ok {
+		t.Fatal(reason)
+	}
+	joinerSk := nostr.GeneratePrivateKey()
+	request := signEvent(t, joinerSk, 9021, nostr.Now(), nostr.Tags{{"h", owner}, {"code", "secret"}}, "it's me")
+	if ok, reason := connectTestClient(t, relayURL, joinerSk).publish(request); !ok {
+		t.Fatal(reason)
+	}
+
+	for _, expected := range []*nostr.Event{invite, request} {
+		got := watcher.receive("live")
+		if got == nil || got.ID != expected.ID {
+			t.Fatalf("expected %d %s live, got %v", expected.Kind, expected.ID, got)
+		}
+		if got.Tags.GetFirst([]string{"code"}) != nil || got.Content != "" || got.Sig != "" {
+			t.Errorf("kind %d went out as it was: %v", got.Kind, got)
+		}
+	}
+
+	// the code still worked
+	if useInviteCode(owner, "secret") {
+		t.Error("the invite code wasn't used by the join request")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Members leave with a kind 9022, which we turn into a relay-signed 9001 so the
+// leave is part of the group's moderation history. Any paid membership they had
+// in the group ends with it.
+
+// validateLeaveRequests only accepts kind 9022 from members of the group.
+func validateLeaveRequests(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.Kind != 9022 {
+		return false, ""
+	}
+	groupId := getGroupIdFromEvent(event, "h")
+	if groupId == "" {
+		return true, "missing group ('h') tag"
+	}
+	if groupId == event.PubKey {
+		return true, "the owner can't leave their own group"
+	}
+
+	group := groups.Snapshot(ctx, groupId, false)
+	if group == nil {
+		return true, "unknown group"
+	}
+	if _, isMember := group.Members[event.PubKey]; !isMember {
+		return true, "not a member of this group"
+	}
+
+	return false, ""
+}
+
+func reactToLeaveRequest(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 9022 {
+		return
+	}
+	groupId := getGroupIdFromEvent(event, "h")
+
+	removeUser := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      9001,
+		Content:   "left the group",
+		Tags: nostr.Tags{
+			nostr.Tag{"h", groupId},
+			nostr.Tag{"p", event.PubKey},
+			nostr.Tag{"e", event.ID},
+		},
+	}
+	if err := removeUser.Sign(s.RelayPrivkey); err != nil {
+		log.Error().Err(err).Msg("failed to sign remove-user event")
+		return
+	}
+	if err := relay.AddEvent(ctx, removeUser); err != nil {
+		log.Error().Err(err).Str("group", groupId).Str("pubkey", event.PubKey).Msg("failed to remove user who left")
+		return
+	}
+
+	// their paid membership, if any, is dropped by applyModerationAction
+	log.Info().Str("group", groupId).Str("pubkey", event.PubKey).Msg("member left")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMembersWhoLeaveAreRemoved(t *testing.T) {
+	relayURL := startTestRelay(t)
+	ctx := context.Background()
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(ctx, owner, owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an admin, so there's something they can write only as a member
+	memberSk := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberSk)
+	ownerClient := connectTestClient(t, relayURL, ownerSk)
+	for _, evt := range []*nostr.Event{
+		signEvent(t, ownerSk, 9000, nostr.Now(), nostr.Tags{{"h", owner}, {"p", member}}, ""),
+		signEvent(t, ownerSk, 9003, nostr.Now(), nostr.Tags{{"h", owner}, {"p", member}, {"permission", PermAddUser}}, ""),
+	} {
+		if ok, reason := ownerClient.publish(evt); !ok {
+			t.Fatal(reason)
+		}
+	}
+
+	isListed := func() bool {
+		members := getGroupEvent(ctx, owner, 39002)
+		return members != nil && members.Tags.GetFirst([]string{"p", member}) != nil
+	}
+	if !isListed() {
+		t.Fatal("member isn't listed")
+	}
+
+	client := connectTestClient(t, relayURL, memberSk)
+	addSomeone := func() (ok bool, reason string) {
+		someone, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+		return client.publish(signEvent(t, memberSk, 9000, nostr.Now(), nostr.Tags{{"h", owner}, {"p", someone}}, ""))
+	}
+	if ok, reason := addSomeone(); !ok {
+		t.Fatalf("member couldn't add someone: %s", reason)
+	}
+
+	leave := signEvent(t, memberSk, 9022, nostr.Now(), nostr.Tags{{"h", owner}}, "")
+	if ok, reason := client.publish(leave); !ok {
+		t.Fatal(reason)
+	}
+
+	if _, isMember := groups.Snapshot(ctx, owner, false).Members[member]; isMember {
+		t.Error("member is still in the group")
+	}
+	if isListed() {
+		t.Error("member who left is still listed")
+	}
+	if ok, reason := addSomeone(); ok || !strings.Contains(reason, "unknown admin") {
+		t.Errorf("member who left could still add someone: %s", reason)
+	}
+	if ok, reason := client.publish(signEvent(t, memberSk, 9022, nostr.Now()+1, nostr.Tags{{"h", owner}}, "")); ok || !strings.Contains(reason, "not a member") {
+		t.Errorf("member who left could leave again: %s", reason)
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/fiatjaf/eventstore/lmdb"
 	"github.com/fiatjaf/khatru"
@@ -24,6 +24,47 @@ type Settings struct {
 	RelayIcon        string `envconfig:"RELAY_ICON"`
 	RelayUrl         string `envconfig:"RELAY_URL"`
 	DatabasePath     string `envconfig:"DATABASE_PATH" default:"./db"`
+	StatePath        string `envconfig:"STATE_PATH" default:"./state"`
+	CheckSnapshots   bool   `envconfig:"CHECK_SNAPSHOTS"`
+	GroupIDScheme    string `envconfig:"GROUP_ID_SCHEME" default:"pubkey"`
+	MaxIndexableTags int    `envconfig:"MAX_INDEXABLE_TAGS" default:"10"`
+
+	// advertised in the NIP-11 document, RELAY_FEES is its "fees" object as JSON
+	RelaySoftware string `envconfig:"RELAY_SOFTWARE" default:"https://github.com/pablof7z/highlighter"`
+	RelayVersion  string `envconfig:"RELAY_VERSION"`
+	PostingPolicy string `envconfig:"POSTING_POLICY"`
+	PaymentsUrl   string `envconfig:"PAYMENTS_URL"`
+	RelayFees     string `envconfig:"RELAY_FEES"`
+
+	MintKeysPath         string   `envconfig:"MINT_KEYS_PATH" default:"./mints"`
+	TrustedZapperPubkeys []string `envconfig:"TRUSTED_ZAPPER_PUBKEYS"`
+
+	// besides the relay key, who can use the NIP-86 management API
+	ManagementPubkeys []string `envconfig:"MANAGEMENT_PUBKEYS"`
+	// IPs of the reverse proxies in front of us, whose X-Forwarded-Host we believe
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
+
+	EncryptGatedContent bool `envconfig:"ENCRYPT_GATED_CONTENT"`
+	TeaserParagraphs    int  `envconfig:"TEASER_PARAGRAPHS" default:"3"`
+
+	MembershipGracePeriod   time.Duration `envconfig:"MEMBERSHIP_GRACE_PERIOD" default:"72h"`
+	MembershipSweepInterval time.Duration `envconfig:"MEMBERSHIP_SWEEP_INTERVAL" default:"1h"`
+
+	DeletionWindow        time.Duration            `envconfig:"DELETION_WINDOW" default:"2h"`
+	DeletionWindowByKind  map[int]time.Duration    `envconfig:"DELETION_WINDOW_BY_KIND"`
+	DeletionWindowByGroup map[string]time.Duration `envconfig:"DELETION_WINDOW_BY_GROUP"`
+
+	// "events/interval", empty to disable a layer. See ratelimit.go
+	RateLimitConnection RateLimit         `envconfig:"RATE_LIMIT_CONNECTION" default:"30/1m"`
+	RateLimitIP         RateLimit         `envconfig:"RATE_LIMIT_IP" default:"60/1m"`
+	RateLimitPubkey     RateLimit         `envconfig:"RATE_LIMIT_PUBKEY" default:"20/1m"`
+	RateLimitGroup      RateLimit         `envconfig:"RATE_LIMIT_GROUP" default:"15/2m"`
+	RateLimitByKind     map[int]RateLimit `envconfig:"RATE_LIMIT_BY_KIND"`
+
+	// NIP-13 difficulty for events sent to open groups. See pow.go
+	PowDifficulty        int            `envconfig:"POW_DIFFICULTY"`
+	PowDifficultyByKind  map[int]int    `envconfig:"POW_DIFFICULTY_BY_KIND"`
+	PowDifficultyByGroup map[string]int `envconfig:"POW_DIFFICULTY_BY_GROUP"`
 
 	RelayPubkey string `envconfig:"-"`
 }
@@ -31,6 +72,7 @@ type Settings struct {
 var (
 	s     Settings
 	db    = &lmdb.LMDBBackend{}
+	state = &StateStore{}
 	log   = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stdout}).With().Timestamp().Logger()
 	relay = khatru.NewRelay()
 )
@@ -51,26 +93,79 @@ func main() {
 	}
 	log.Debug().Str("path", db.Path).Msg("initialized database")
 
+	state.Path = s.StatePath
+	if err := state.Init(); err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize state database")
+		return
+	}
+	log.Debug().Str("path", state.Path).Msg("initialized state database")
+
+	if err := loadMintKeysets(s.MintKeysPath); err != nil {
+		log.Fatal().Err(err).Msg("failed to load mint keysets")
+		return
+	}
+	log.Debug().Int("mints", len(mintKeysets)).Msg("loaded mint keysets")
+
+	if err := backfillSnapshots(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("failed to backfill group snapshots")
+		return
+	}
+
+	if s.CheckSnapshots {
+		if err := checkSnapshots(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("failed to check group snapshots")
+			return
+		}
+	}
+
+	if err := buildVisibilityIndex(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("failed to build visibility index")
+		return
+	}
+
 	// init relay
-	relay.Info.Name = s.RelayName
-	relay.Info.PubKey = s.RelayPubkey
-	relay.Info.Description = s.RelayDescription
-	relay.Info.Contact = s.RelayContact
-	relay.Info.Icon = s.RelayIcon
 	relay.ServiceURL = s.RelayUrl
+	if err := initRelayInfo(); err != nil {
+		log.Fatal().Err(err).Msg("failed to set up relay information")
+		return
+	}
+	if err := loadRelayInfo(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load relay information")
+		return
+	}
+
+	setupRelay()
+
+	go sweepMemberships(context.Background())
+	go sweepRateLimiters(context.Background())
+
+	// http routes
+	relay.Router().HandleFunc("/create", handleCreateGroup)
+	relay.Router().HandleFunc("/", handleRoot)
+
+	log.Info().Msg("running on http://0.0.0.0:" + s.Port)
+	if err := http.ListenAndServe(":"+s.Port, serveRelayInformation(relay)); err != nil {
+		log.Fatal().Err(err).Msg("failed to serve")
+	}
+}
 
-	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
+// setupRelay plugs our policies and handlers into khatru
+func setupRelay() {
+	relay.StoreEvent = append(relay.StoreEvent, storeEvent)
 	relay.QueryEvents = append(relay.QueryEvents,
 		// db.QueryEvents,
 		metadataQueryHandler,
 		membersQueryHandler,
-		// adminsQueryHandler,
+		adminsQueryHandler,
 		contentQueryHandler,
 	)
 	relay.CountEvents = append(relay.CountEvents, db.CountEvents)
-	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
+	relay.DeleteEvent = append(relay.DeleteEvent, deleteEvent)
 	relay.OverwriteDeletionOutcome = append(relay.OverwriteDeletionOutcome,
-		blockDeletesOfOldMessages,
+		deletionPolicy,
+	)
+	relay.OverwriteResponseEvent = append(relay.OverwriteResponseEvent,
+		prepareBroadcast,
 	)
 	// relay.OverwriteFilter = append(
 	// 	relay.OverwriteFilter,
@@ -86,14 +181,17 @@ func main() {
 		// },
 		// require
 		// requireKindAndSingleGroupID,
+		rejectBannedFilters,
 		requireAuth,
 	)
 	relay.RejectEvent = append(relay.RejectEvent,
 		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-			fmt.Println("EVENT", event)
+			log.Debug().Str("event", event.ID).Int("kind", event.Kind).Str("pubkey", event.PubKey).Msg("received event")
 			return false, ""
 		},
-		policies.PreventTooManyIndexableTags(10, []int{30023, 39002}, nil),
+		rejectBannedEvents,
+		rejectRelayEncryptedEvents,
+		policies.PreventTooManyIndexableTags(s.MaxIndexableTags, []int{30023, 39002}, nil),
 		// func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 		// 	if event.Kind != 0 {
 		// 		policies.PreventTimestampsInThePast(60)
@@ -103,33 +201,36 @@ func main() {
 		// },
 		// requireHTag,
 
+		requireProofOfWork,
 		enforceGroupEvents,
 		// restrictGroupWritesToMembers,
 		// restrictWritesBasedOnGroupRules,
 		restrictInvalidModerationActions,
+		validateLeaveRequests,
+		validateSubscriptions,
+		validateNutzaps,
+		validateZapReceipts,
 		rateLimit,
 	)
 	relay.OnEventSaved = append(relay.OnEventSaved,
 		applyModerationAction,
+		deleteModeratedEvents,
+		ingestPaymentReceipt,
+		ingestNutzap,
+		ingestZapReceipt,
 		reactToJoinRequest,
+		updateJoinRequests,
+		reactToLeaveRequest,
+		indexVisibility,
 	)
 	relay.OnConnect = append(
 		relay.OnConnect,
+		trackConnection,
 		func(ctx context.Context) {
-			fmt.Println("connected, requesting auth")
-			// sleep for 2 seconds to test something
-			// time.Sleep(2 * time.Second)
-			fmt.Println("requesting auth now")
+			log.Debug().Msg("connected, requesting auth")
 			khatru.RequestAuth(ctx)
 		},
 	)
 
-	// http routes
-	// relay.Router().HandleFunc("/create", handleCreateGroup)
-	// relay.Router().HandleFunc("/", handleHomepage)
-
-	log.Info().Msg("running on http://0.0.0.0:" + s.Port)
-	if err := http.ListenAndServe(":"+s.Port, relay); err != nil {
-		log.Fatal().Err(err).Msg("failed to serve")
-	}
+	relay.OnDisconnect = append(relay.OnDisconnect, untrackConnection)
 }
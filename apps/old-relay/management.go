@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"golang.org/x/exp/slices"
+)
+
+// NIP-86 relay management. Operators (the relay key and ManagementPubkeys) POST
+// JSON-RPC-like requests to the relay url with NIP-98 auth. What they change is
+// kept in the state store so it survives restarts, and is enforced by
+// rejectBannedEvents and rejectBannedFilters.
+
+// ManagementEntry is a ban or an allowance made through the management API
+type ManagementEntry struct {
+	Reason string          `json:"reason"`
+	By     string          `json:"by"`
+	At     nostr.Timestamp `json:"at"`
+}
+
+type managementRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type managementResponse struct {
+	Result any    `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type managementMethod func(ctx context.Context, operator string, params []json.RawMessage) (any, error)
+
+var managementMethods map[string]managementMethod
+
+func init() {
+	// set here because supportedmethods refers to the map
+	managementMethods = map[string]managementMethod{
+		"supportedmethods":            supportedMethods,
+		"banpubkey":                   banPubkey,
+		"allowpubkey":                 allowPubkey,
+		"listbannedpubkeys":           listEntries("banned-pubkeys", "pubkey"),
+		"listallowedpubkeys":          listEntries("allowed-pubkeys", "pubkey"),
+		"banevent":                    banEvent,
+		"allowevent":                  allowEvent,
+		"listbannedevents":            listEntries("banned-events", "id"),
+		"listeventsneedingmoderation": listEventsNeedingModeration,
+		"allowkind":                   allowKind,
+		"disallowkind":                disallowKind,
+		"listallowedkinds":            listAllowedKinds,
+		"blockip":                     blockIP,
+		"unblockip":                   unblockIP,
+		"listblockedips":              listEntries("blocked-ips", "ip"),
+		"changerelayname":             changeRelayInfo("name"),
+		"changerelaydescription":      changeRelayInfo("description"),
+		"changerelayicon":             changeRelayInfo("icon"),
+	}
+}
+
+func isOperator(pubkey string) bool {
+	return pubkey == s.RelayPubkey || slices.Contains(s.ManagementPubkeys, pubkey)
+}
+
+func isManagementRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/nostr+json+rpc"
+}
+
+func handleManagement(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeManagementResponse(w, http.StatusBadRequest, nil, "failed to read request")
+		return
+	}
+
+	operator, err := validateNIP98(r, body)
+	if err != nil {
+		writeManagementResponse(w, http.StatusUnauthorized, nil, err.Error())
+		return
+	}
+	if !isOperator(operator) {
+		writeManagementResponse(w, http.StatusUnauthorized, nil, "not an operator of this relay")
+		return
+	}
+
+	var req managementRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeManagementResponse(w, http.StatusBadRequest, nil, "invalid request")
+		return
+	}
+	method, ok := managementMethods[req.Method]
+	if !ok {
+		writeManagementResponse(w, http.StatusOK, nil, fmt.Sprintf("unsupported method '%s'", req.Method))
+		return
+	}
+
+	result, err := method(r.Context(), operator, req.Params)
+	if err != nil {
+		writeManagementResponse(w, http.StatusOK, nil, err.Error())
+		return
+	}
+
+	log.Info().Str("operator", operator).Str("method", req.Method).Msg("relay management")
+	writeManagementResponse(w, http.StatusOK, result, "")
+}
+
+func writeManagementResponse(w http.ResponseWriter, status int, result any, errMsg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(managementResponse{Result: result, Error: errMsg})
+}
+
+// stringParam returns the i-th parameter, which must be a string unless it is
+// optional and missing
+func stringParam(params []json.RawMessage, i int, optional bool) (string, error) {
+	if i >= len(params) {
+		if optional {
+			return "", nil
+		}
+		return "", fmt.Errorf("missing parameter %d", i+1)
+	}
+	var value string
+	if err := json.Unmarshal(params[i], &value); err != nil {
+		return "", fmt.Errorf("parameter %d must be a string", i+1)
+	}
+	return value, nil
+}
+
+func intParam(params []json.RawMessage, i int) (int, error) {
+	if i >= len(params) {
+		return 0, fmt.Errorf("missing parameter %d", i+1)
+	}
+	var value int
+	if err := json.Unmarshal(params[i], &value); err != nil {
+		return 0, fmt.Errorf("parameter %d must be a number", i+1)
+	}
+	return value, nil
+}
+
+// putEntry records params[0] (checked with valid) in bucket, with params[1] as
+// the reason
+func putEntry(bucket string, operator string, params []json.RawMessage, valid func(string) bool) (string, error) {
+	key, err := stringParam(params, 0, false)
+	if err != nil {
+		return "", err
+	}
+	if !valid(key) {
+		return "", fmt.Errorf("invalid '%s'", key)
+	}
+	reason, err := stringParam(params, 1, true)
+	if err != nil {
+		return "", err
+	}
+	return key, state.Put(bucket, key, ManagementEntry{Reason: reason, By: operator, At: nostr.Now()})
+}
+
+func listEntries(bucket string, keyName string) managementMethod {
+	return func(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+		list := make([]map[string]string, 0)
+		err := state.ForEach(bucket, "", func(key string, raw []byte) error {
+			var entry ManagementEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			list = append(list, map[string]string{keyName: key, "reason": entry.Reason})
+			return nil
+		})
+		return list, err
+	}
+}
+
+func supportedMethods(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	methods := make([]string, 0, len(managementMethods))
+	for name := range managementMethods {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	return methods, nil
+}
+
+func banPubkey(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	pubkey, err := putEntry("banned-pubkeys", operator, params, nostr.IsValidPublicKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	return true, state.Delete("allowed-pubkeys", pubkey)
+}
+
+func allowPubkey(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	pubkey, err := putEntry("allowed-pubkeys", operator, params, nostr.IsValidPublicKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	return true, state.Delete("banned-pubkeys", pubkey)
+}
+
+// banEvent deletes the event, if we have it, and keeps it from coming back
+func banEvent(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	id, err := putEntry("banned-events", operator, params, nostr.IsValid32ByteHex)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return nil, err
+	}
+	var found []*nostr.Event
+	for evt := range ch {
+		found = append(found, evt)
+	}
+	for _, evt := range found {
+		if err := deleteEvent(ctx, evt); err != nil {
+			return nil, err
+		}
+	}
+	return true, nil
+}
+
+func allowEvent(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	id, err := stringParam(params, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return true, state.Delete("banned-events", id)
+}
+
+// we don't hold events for review, nothing ever needs moderation
+func listEventsNeedingModeration(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	return []map[string]string{}, nil
+}
+
+func allowKind(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	kind, err := intParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	return true, state.Put("allowed-kinds", strconv.Itoa(kind), ManagementEntry{By: operator, At: nostr.Now()})
+}
+
+func disallowKind(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	kind, err := intParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	return true, state.Delete("allowed-kinds", strconv.Itoa(kind))
+}
+
+func listAllowedKinds(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	kinds, err := allowedKinds()
+	if kinds == nil {
+		kinds = []int{}
+	}
+	return kinds, err
+}
+
+// allowedKinds returns the kinds operators restricted the relay to, if any
+func allowedKinds() ([]int, error) {
+	var kinds []int
+	err := state.ForEach("allowed-kinds", "", func(key string, raw []byte) error {
+		kind, err := strconv.Atoi(key)
+		if err != nil {
+			return err
+		}
+		kinds = append(kinds, kind)
+		return nil
+	})
+	sort.Ints(kinds)
+	return kinds, err
+}
+
+func blockIP(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	if _, err := putEntry("blocked-ips", operator, params, func(ip string) bool {
+		return net.ParseIP(ip) != nil
+	}); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func unblockIP(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+	ip, err := stringParam(params, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	return true, state.Delete("blocked-ips", ip)
+}
+
+// relayInfoFields are the relay information fields operators can change
+var relayInfoFields = map[string]func(info *nip11.RelayInformationDocument) *string{
+	"name":        func(info *nip11.RelayInformationDocument) *string { return &info.Name },
+	"description": func(info *nip11.RelayInformationDocument) *string { return &info.Description },
+	"icon":        func(info *nip11.RelayInformationDocument) *string { return &info.Icon },
+}
+
+// changeRelayInfo updates a relay information field now and for next starts
+func changeRelayInfo(name string) managementMethod {
+	return func(ctx context.Context, operator string, params []json.RawMessage) (any, error) {
+		value, err := stringParam(params, 0, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := state.Put("relay-info", name, value); err != nil {
+			return nil, err
+		}
+		relayInfoMutex.Lock()
+		*relayInfoFields[name](relay.Info) = value
+		relayInfoMutex.Unlock()
+		return true, nil
+	}
+}
+
+// loadRelayInfo applies the relay information operators changed over the
+// values from the environment.
+func loadRelayInfo() error {
+	relayInfoMutex.Lock()
+	defer relayInfoMutex.Unlock()
+
+	for name, field := range relayInfoFields {
+		if _, err := state.Get("relay-info", name, field(relay.Info)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectionIP is the IP of the client behind ctx, or "" when the context
+// doesn't come from a client connection.
+func connectionIP(ctx context.Context) string {
+	if clientConnection(ctx) == nil {
+		return ""
+	}
+	ip := khatru.GetIP(ctx)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// hasEntries tells if anything was put in bucket
+func hasEntries(bucket string) (bool, error) {
+	found := false
+	err := state.ForEach(bucket, "", func(key string, raw []byte) error {
+		found = true
+		return errStopIteration
+	})
+	if err == errStopIteration {
+		err = nil
+	}
+	return found, err
+}
+
+var errStopIteration = errors.New("stop")
+
+// hasEntry tells if key was put in bucket, be it a ban or an allowance
+func hasEntry(bucket string, key string) bool {
+	if key == "" {
+		return false
+	}
+	found, err := state.Get(bucket, key, new(ManagementEntry))
+	if err != nil {
+		log.Error().Err(err).Str("bucket", bucket).Msg("failed to check entry")
+	}
+	return found
+}
+
+// rejectBannedEvents enforces the bans and the kind restrictions operators made
+// through the management API. Events we sign ourselves are never rejected.
+func rejectBannedEvents(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.PubKey == s.RelayPubkey {
+		return false, ""
+	}
+
+	if hasEntry("blocked-ips", connectionIP(ctx)) {
+		return true, "blocked: your IP is blocked"
+	}
+	if hasEntry("banned-pubkeys", event.PubKey) {
+		return true, "blocked: pubkey is banned"
+	}
+	if hasEntry("banned-events", event.ID) {
+		return true, "blocked: event is banned"
+	}
+
+	// like kinds, once some pubkeys are allowed only they can write
+	if !isOperator(event.PubKey) {
+		restricted, err := hasEntries("allowed-pubkeys")
+		if err != nil {
+			log.Error().Err(err).Msg("failed to load allowed pubkeys")
+			return true, "error: failed to check pubkey"
+		}
+		if restricted && !hasEntry("allowed-pubkeys", event.PubKey) {
+			return true, "restricted: pubkey not allowed on this relay"
+		}
+	}
+
+	kinds, err := allowedKinds()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load allowed kinds")
+		return true, "error: failed to check kind"
+	}
+	if len(kinds) > 0 && !slices.Contains(kinds, event.Kind) {
+		return true, "blocked: kind not allowed on this relay"
+	}
+
+	return false, ""
+}
+
+// rejectBannedFilters keeps blocked IPs and banned pubkeys from reading.
+func rejectBannedFilters(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if hasEntry("blocked-ips", connectionIP(ctx)) {
+		return true, "blocked: your IP is blocked"
+	}
+	if hasEntry("banned-pubkeys", authedPubkey(ctx)) {
+		return true, "blocked: pubkey is banned"
+	}
+	return false, ""
+}
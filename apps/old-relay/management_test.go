@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAllowedPubkeysRestrictWrites(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	allowedSk, strangerSk := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	allowed, _ := nostr.GetPublicKey(allowedSk)
+
+	post := func(sk string) *nostr.Event {
+		return signEvent(t, sk, 1, nostr.Now(), nil, "hello")
+	}
+
+	// nobody was allowed yet, so everybody can write
+	if reject, msg := rejectBannedEvents(ctx, post(strangerSk)); reject {
+		t.Fatalf("rejected before any pubkey was allowed: %s", msg)
+	}
+
+	param, _ := json.Marshal(allowed)
+	if _, err := allowPubkey(ctx, s.RelayPubkey, []json.RawMessage{param}); err != nil {
+		t.Fatal(err)
+	}
+	if reject, msg := rejectBannedEvents(ctx, post(allowedSk)); reject {
+		t.Errorf("allowed pubkey rejected: %s", msg)
+	}
+	if reject, msg := rejectBannedEvents(ctx, post(strangerSk)); !reject || !strings.HasPrefix(msg, "restricted:") {
+		t.Errorf("pubkey that wasn't allowed could write: %s", msg)
+	}
+	if reject, msg := rejectBannedEvents(ctx, post(s.RelayPrivkey)); reject {
+		t.Errorf("relay rejected: %s", msg)
+	}
+}
+
+func TestForwardedHostOnlyFromTrustedProxies(t *testing.T) {
+	setupTestRelay(t)
+	previous := s.TrustedProxies
+	s.TrustedProxies = []string{"10.0.0.1"}
+	t.Cleanup(func() { s.TrustedProxies = previous })
+
+	for _, tc := range []struct {
+		remote   string
+		signed   string
+		expected bool
+	}{
+		{"10.0.0.1:4000", "https://relay.example.com/", true},
+		{"10.0.0.1:4000", "https://internal:5577/", false},
+		{"203.0.113.7:4000", "https://relay.example.com/", false},
+		{"203.0.113.7:4000", "https://internal:5577/", true},
+	} {
+		r := httptest.NewRequest("POST", "http://internal:5577/", nil)
+		r.RemoteAddr = tc.remote
+		r.Header.Set("X-Forwarded-Host", "relay.example.com")
+		if same := sameRequestURL(tc.signed, r); same != tc.expected {
+			t.Errorf("%s signed from %s: got %v, expected %v", tc.signed, tc.remote, same, tc.expected)
+		}
+	}
+}
+
+func TestChangeRelayInfoWhileServing(t *testing.T) {
+	setupTestRelay(t)
+	if err := initRelayInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	change := managementMethods["changerelayname"]
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			param, _ := json.Marshal("renamed")
+			if _, err := change(context.Background(), s.RelayPubkey, []json.RawMessage{param}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			relayInformation()
+		}()
+	}
+	wg.Wait()
+
+	if name := relayInformation().Name; name != "renamed" {
+		t.Errorf("name is %q", name)
+	}
+}
+
+func TestNIP98AuthCantBeReplayed(t *testing.T) {
+	setupTestRelay(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	r := nip98Request(t, sk, "POST", "https://relay.example.com/", `{"method":"supportedmethods"}`)
+	body := []byte(`{"method":"supportedmethods"}`)
+
+	if signer, err := validateNIP98(r, body); err != nil || signer != pubkey {
+		t.Fatalf("valid authorization refused: %v", err)
+	}
+	if _, err := validateNIP98(r, body); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("authorization replayed: %v", err)
+	}
+
+	// nor with another id slapped on it
+	var evt nostr.Event
+	raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "Nostr "))
+	json.Unmarshal(raw, &evt)
+	evt.ID = strings.Repeat("0", 64)
+	raw, _ = json.Marshal(evt)
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	if _, err := validateNIP98(r, body); err == nil {
+		t.Fatal("authorization replayed under another id")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// PaidMembership is a tier membership the relay granted because it was paid
+// for. They are kept in the state store and published in the relay-signed
+// kind 39002 list of each group, which is what loadMemberships trusts.
+type PaidMembership struct {
+	Group        string          `json:"group"`
+	Pubkey       string          `json:"pubkey"`
+	Tier         string          `json:"tier"`
+	Subscription string          `json:"subscription"`
+	Receipts     []string        `json:"receipts"`
+	Since        nostr.Timestamp `json:"since"`
+	PaidUntil    nostr.Timestamp `json:"paid_until"`
+}
+
+var cadenceDurations = map[string]time.Duration{
+	"daily":     24 * time.Hour,
+	"weekly":    7 * 24 * time.Hour,
+	"monthly":   30 * 24 * time.Hour,
+	"quarterly": 91 * 24 * time.Hour,
+	"yearly":    365 * 24 * time.Hour,
+}
+
+// serializes updates to memberships and the publishing of the lists
+var membershipsMutex sync.Mutex
+
+func membershipKey(groupId string, pubkey string) string {
+	return groupId + ":" + pubkey
+}
+
+func grantMembership(ctx context.Context, sub *Subscription, payment Payment) error {
+	membershipsMutex.Lock()
+	defer membershipsMutex.Unlock()
+
+	var membership PaidMembership
+	key := membershipKey(sub.GroupID, sub.Subscriber)
+	if _, err := state.Get("memberships", key, &membership); err != nil {
+		return err
+	}
+	if slices.Contains(membership.Receipts, payment.Receipt) {
+		// already credited
+		return nil
+	}
+
+	// each payment covers as many periods as it pays for, starting when the
+	// previous ones end or now if they have already lapsed
+	now := nostr.Now()
+	periods := payment.Amount.Amount / sub.Amount.Amount
+	if periods < 1 {
+		periods = 1
+	}
+	start := membership.PaidUntil
+	if start < now || membership.Tier != sub.TierID {
+		start = now
+		membership.Since = now
+	}
+	covered := time.Duration(periods) * cadenceDurations[sub.Amount.Cadence]
+
+	membership.Group = sub.GroupID
+	membership.Pubkey = sub.Subscriber
+	membership.Tier = sub.TierID
+	membership.Subscription = sub.ID
+	membership.Receipts = append(membership.Receipts, payment.Receipt)
+	membership.PaidUntil = start + nostr.Timestamp(covered.Seconds())
+	if err := state.Put("memberships", key, membership); err != nil {
+		return err
+	}
+
+	if group := groups.Snapshot(ctx, sub.GroupID, false); group != nil {
+		if _, isMember := group.Members[sub.Subscriber]; !isMember {
+			if err := addPaidMember(ctx, sub.GroupID, sub.Subscriber); err != nil {
+				return err
+			}
+		}
+	}
+
+	return refreshGroupEvents(ctx, sub.GroupID, 39002)
+}
+
+// addPaidMember adds whoever paid for a membership to the group with a
+// relay-signed kind 9000, so it is part of the moderation history.
+func addPaidMember(ctx context.Context, groupId string, pubkey string) error {
+	addUser := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      9000,
+		Content:   "paid membership",
+		Tags: nostr.Tags{
+			nostr.Tag{"h", groupId},
+			nostr.Tag{"p", pubkey},
+		},
+	}
+	if err := addUser.Sign(s.RelayPrivkey); err != nil {
+		return err
+	}
+	return relay.AddEvent(ctx, addUser)
+}
+
+// dropPaidMembership forgets the paid membership of pubkey in a group, if any,
+// leaving it to the caller to republish the group's list.
+func dropPaidMembership(groupId string, pubkey string) (found bool, err error) {
+	membershipsMutex.Lock()
+	defer membershipsMutex.Unlock()
+
+	key := membershipKey(groupId, pubkey)
+	var membership PaidMembership
+	if found, err := state.Get("memberships", key, &membership); err != nil || !found {
+		return false, err
+	}
+	if err := state.Delete("memberships", key); err != nil {
+		return false, err
+	}
+	log.Info().Str("group", groupId).Str("subscriber", pubkey).Str("tier", membership.Tier).Msg("membership cancelled")
+	return true, nil
+}
+
+func loadPaidMemberships(groupId string) ([]PaidMembership, error) {
+	var memberships []PaidMembership
+	err := state.ForEach("memberships", groupId+":", func(key string, raw []byte) error {
+		var membership PaidMembership
+		if err := json.Unmarshal(raw, &membership); err != nil {
+			return fmt.Errorf("membership '%s': %w", key, err)
+		}
+		memberships = append(memberships, membership)
+		return nil
+	})
+	return memberships, err
+}
+
+// sweepMemberships periodically drops memberships that lapsed more than the
+// grace period ago and republishes the lists of the groups they were in.
+func sweepMemberships(ctx context.Context) {
+	ticker := time.NewTicker(s.MembershipSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := sweepLapsedMemberships(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to sweep lapsed memberships")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepLapsedMemberships(ctx context.Context) error {
+	membershipsMutex.Lock()
+	defer membershipsMutex.Unlock()
+
+	deadline := nostr.Now() - nostr.Timestamp(s.MembershipGracePeriod.Seconds())
+
+	var lapsed []PaidMembership
+	if err := state.ForEach("memberships", "", func(key string, raw []byte) error {
+		var membership PaidMembership
+		if err := json.Unmarshal(raw, &membership); err != nil {
+			return fmt.Errorf("membership '%s': %w", key, err)
+		}
+		if membership.PaidUntil < deadline {
+			lapsed = append(lapsed, membership)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	changedGroups := make(map[string]struct{})
+	for _, membership := range lapsed {
+		if err := state.Delete("memberships", membershipKey(membership.Group, membership.Pubkey)); err != nil {
+			return err
+		}
+		changedGroups[membership.Group] = struct{}{}
+		log.Info().Str("group", membership.Group).Str("subscriber", membership.Pubkey).
+			Str("tier", membership.Tier).Msg("membership lapsed")
+	}
+
+	for groupId := range changedGroups {
+		if err := refreshGroupEvents(ctx, groupId, 39002); err != nil {
+			log.Error().Err(err).Str("group", groupId).Msg("failed to publish members list")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRemovedMembersAreNoLongerListedAsPaid(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	subscriber, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := createGroup(ctx, owner, owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := grantMembership(ctx, &Subscription{
+		ID:         "subscription",
+		Subscriber: subscriber,
+		Creator:    owner,
+		TierID:     "gold",
+		GroupID:    owner,
+		Amount:     TierAmount{Amount: 21, Currency: "sat", Cadence: "monthly"},
+	}, Payment{Receipt: "receipt", Amount: TierAmount{Amount: 21, Currency: "sat"}}); err != nil {
+		t.Fatal(err)
+	}
+	listed := func() bool {
+		members := getGroupEvent(ctx, owner, 39002)
+		if members == nil {
+			t.Fatal("no members list")
+		}
+		return members.Tags.GetFirst([]string{"p", subscriber}) != nil
+	}
+	if !listed() {
+		t.Fatal("paying member isn't listed")
+	}
+
+	remove := signEvent(t, s.RelayPrivkey, 9001, nostr.Now()+1, nostr.Tags{{"h", owner}, {"p", subscriber}}, "")
+	saveTestEvent(t, remove)
+	applyModerationAction(ctx, remove)
+	if listed() {
+		t.Error("removed member is still listed")
+	}
+
+	if memberships, err := loadPaidMemberships(owner); err != nil {
+		t.Fatal(err)
+	} else if len(memberships) != 0 {
+		t.Errorf("removed member kept their paid membership: %v", memberships)
+	}
+}
+
+func TestConnectionHelpersOutsideConnections(t *testing.T) {
+	ctx := context.Background()
+	if pubkey := authedPubkey(ctx); pubkey != "" {
+		t.Errorf("authed as %q without a connection", pubkey)
+	}
+	if key := connectionKey(ctx); key != "" {
+		t.Errorf("connection %q without a connection", key)
+	}
+	if ip := connectionIP(ctx); ip != "" {
+		t.Errorf("ip %q without a connection", ip)
+	}
+}
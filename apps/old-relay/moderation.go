@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -11,6 +12,8 @@ type Action interface {
 	PermissionName() Permission
 }
 
+var errUnknownModerationAction = errors.New("unknown moderation action")
+
 var moderationActionFactories = map[int]func(*nostr.Event) (Action, error){
 	9000: func(evt *nostr.Event) (Action, error) {
 		targets := make([]string, 0, len(evt.Tags))
@@ -119,7 +122,7 @@ var moderationActionFactories = map[int]func(*nostr.Event) (Action, error){
 
 		targets := make([]string, len(tags))
 		for i, tag := range tags {
-			if nostr.IsValidPublicKeyHex(tag[1]) {
+			if nostr.IsValid32ByteHex(tag[1]) {
 				targets[i] = tag[1]
 			} else {
 				return nil, fmt.Errorf("invalid event id hex")
@@ -146,7 +149,106 @@ var moderationActionFactories = map[int]func(*nostr.Event) (Action, error){
 
 		return egs, nil
 	},
+	9010: func(evt *nostr.Event) (Action, error) {
+		name, err := roleNameFromEvent(evt)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("missing 'role' tag")
+		}
+
+		permissions := make([]string, 0, len(evt.Tags)-1)
+		for _, tag := range evt.Tags.GetAll([]string{"permission", ""}) {
+			if _, ok := availablePermissions[tag[1]]; !ok {
+				return nil, fmt.Errorf("unknown permission '%s'", tag[1])
+			}
+			permissions = append(permissions, tag[1])
+		}
+
+		return &EditRole{Name: name, Permissions: permissions}, nil
+	},
+	9011: func(evt *nostr.Event) (Action, error) {
+		name, err := roleNameFromEvent(evt)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("missing 'role' tag")
+		}
+
+		return &DeleteRole{Name: name}, nil
+	},
+	9012: func(evt *nostr.Event) (Action, error) {
+		// without a 'role' tag the targets lose whatever role they had
+		name, err := roleNameFromEvent(evt)
+		if err != nil {
+			return nil, err
+		}
+
+		targets := make([]string, 0, len(evt.Tags)-1)
+		for _, tag := range evt.Tags.GetAll([]string{"p", ""}) {
+			if !nostr.IsValidPublicKeyHex(tag[1]) {
+				return nil, fmt.Errorf("invalid public key hex")
+			}
+			if tag[1] == s.RelayPubkey {
+				continue
+			}
+			targets = append(targets, tag[1])
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("missing 'p' tags")
+		}
+
+		return &AssignRole{Targets: targets, Name: name}, nil
+	},
+	9009: func(evt *nostr.Event) (Action, error) {
+		tags := evt.Tags.GetAll([]string{"code", ""})
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("missing 'code' tag")
+		}
+
+		codes := make([]string, len(tags))
+		for i, tag := range tags {
+			codes[i] = tag[1]
+		}
+
+		return &CreateInvite{Codes: codes}, nil
+	},
+	9013: func(evt *nostr.Event) (Action, error) {
+		targets, err := joinRequestTargets(evt)
+		if err != nil {
+			return nil, err
+		}
+		return &ApproveJoinRequest{Targets: targets}, nil
+	},
+	9014: func(evt *nostr.Event) (Action, error) {
+		targets, err := joinRequestTargets(evt)
+		if err != nil {
+			return nil, err
+		}
+		return &RejectJoinRequest{Targets: targets, Reason: evt.Content}, nil
+	},
+	9015: func(evt *nostr.Event) (Action, error) {
+		tag := evt.Tags.GetFirst([]string{"rate-limit"})
+		if tag == nil {
+			return nil, fmt.Errorf("missing 'rate-limit' tag")
+		}
+
+		// without a value the group goes back to the relay's default
+		var limit RateLimit
+		if len(*tag) >= 2 {
+			if err := limit.Decode((*tag)[1]); err != nil {
+				return nil, err
+			}
+		}
+		return &EditRateLimit{Limit: limit}, nil
+	},
 	39002: func(evt *nostr.Event) (Action, error) {
+		if !isTrustedMembershipList(evt, getGroupIdFromEvent(evt, "h")) {
+			return nil, fmt.Errorf("membership list not issued by the relay or the group owner")
+		}
+
 		tags := evt.Tags.GetAll([]string{"p", ""})
 		if len(tags) == 0 {
 			return nil, fmt.Errorf("missing 'p' tag")
@@ -169,9 +271,42 @@ type DeleteEvent struct {
 	Targets []string
 }
 
+// the events themselves are removed from the store by deleteModeratedEvents,
+// there is nothing to change in the group state
 func (DeleteEvent) PermissionName() Permission { return PermDeleteEvent }
 func (a DeleteEvent) Apply(group *Group)       {}
 
+// invite codes are kept by recordInviteCodes, they're not part of the group state
+type CreateInvite struct {
+	Codes []string
+}
+
+func (CreateInvite) PermissionName() Permission { return PermAddUser }
+func (a CreateInvite) Apply(group *Group)       {}
+
+// ApproveJoinRequest is like AddUser but only for people who asked to join, the
+// queue itself is updated by updateJoinRequests
+type ApproveJoinRequest struct {
+	Targets []string
+}
+
+func (ApproveJoinRequest) PermissionName() Permission { return PermAddUser }
+func (a ApproveJoinRequest) Apply(group *Group) {
+	for _, target := range a.Targets {
+		if _, isMember := group.Members[target]; !isMember {
+			group.Members[target] = emptyRole
+		}
+	}
+}
+
+type RejectJoinRequest struct {
+	Targets []string
+	Reason  string
+}
+
+func (RejectJoinRequest) PermissionName() Permission { return PermAddUser }
+func (a RejectJoinRequest) Apply(group *Group)       {}
+
 type AddUser struct {
 	Targets []string
 }
@@ -218,6 +353,12 @@ type AddPermission struct {
 func (AddPermission) PermissionName() Permission { return PermAddPermission }
 func (a AddPermission) Apply(group *Group) {
 	for _, target := range a.Targets {
+		// the relay already has every permission through masterRole, which is
+		// shared by all groups and must never be modified
+		if target == s.RelayPubkey {
+			continue
+		}
+
 		role, ok := group.Members[target]
 
 		// if it's a normal user, create a new permissions object thing for this user
@@ -225,6 +366,11 @@ func (a AddPermission) Apply(group *Group) {
 		if !ok || role == emptyRole {
 			role = &Role{Permissions: make(map[string]struct{})}
 			group.Members[target] = role
+		} else if group.isDefinedRole(role) {
+			// same for named roles, as they're shared with other members. this
+			// member keeps the name but won't follow later edits to the role
+			role = role.copy()
+			group.Members[target] = role
 		}
 
 		// add all permissions listed
@@ -250,6 +396,10 @@ func (a RemovePermission) Apply(group *Group) {
 		if !ok || role == emptyRole {
 			continue
 		}
+		if group.isDefinedRole(role) {
+			role = role.copy()
+			group.Members[target] = role
+		}
 
 		// remove all permissions listed
 		for _, perm := range a.Permissions {
@@ -284,3 +434,109 @@ func (a EditGroupStatus) Apply(group *Group) {
 		group.Closed = true
 	}
 }
+
+type EditRateLimit struct {
+	Limit RateLimit
+}
+
+func (EditRateLimit) PermissionName() Permission { return PermEditGroupStatus }
+func (a EditRateLimit) Apply(group *Group) {
+	group.RateLimit = a.Limit
+	group.bucket = group.rateLimit().newLimiter()
+}
+
+type EditRole struct {
+	Name        string
+	Permissions []Permission
+}
+
+func (EditRole) PermissionName() Permission { return PermEditRoles }
+func (a EditRole) Apply(group *Group) {
+	role, ok := group.Roles[a.Name]
+	if !ok {
+		role = &Role{Name: a.Name}
+		group.Roles[a.Name] = role
+	}
+
+	// the bundle is replaced as a whole, members holding this role see the change
+	role.Permissions = make(map[Permission]struct{}, len(a.Permissions))
+	for _, perm := range a.Permissions {
+		role.Permissions[perm] = struct{}{}
+	}
+}
+
+type DeleteRole struct {
+	Name string
+}
+
+func (DeleteRole) PermissionName() Permission { return PermEditRoles }
+func (a DeleteRole) Apply(group *Group) {
+	role, ok := group.Roles[a.Name]
+	if !ok {
+		return
+	}
+	delete(group.Roles, a.Name)
+
+	// whoever had this role is now a normal member
+	for pubkey, memberRole := range group.Members {
+		if memberRole == role {
+			group.Members[pubkey] = emptyRole
+		}
+	}
+}
+
+type AssignRole struct {
+	Targets []string
+	Name    string
+}
+
+// assigning a role is the same as giving all of its permissions at once
+func (AssignRole) PermissionName() Permission { return PermAddPermission }
+func (a AssignRole) Apply(group *Group) {
+	role := emptyRole
+	if a.Name != "" {
+		var ok bool
+		if role, ok = group.Roles[a.Name]; !ok {
+			return
+		}
+	}
+
+	for _, target := range a.Targets {
+		if target == s.RelayPubkey {
+			continue
+		}
+		group.Members[target] = role
+	}
+}
+
+func roleNameFromEvent(evt *nostr.Event) (string, error) {
+	tag := evt.Tags.GetFirst([]string{"role", ""})
+	if tag == nil {
+		return "", nil
+	}
+	name := (*tag)[1]
+	if name == masterRole.Name {
+		return "", fmt.Errorf("role name '%s' is reserved", name)
+	}
+	return name, nil
+}
+
+// isDefinedRole tells if role is one of the group's named role definitions,
+// which are shared and must not be changed on behalf of a single member.
+func (group *Group) isDefinedRole(role *Role) bool {
+	return role != emptyRole && role.Name != "" && group.Roles[role.Name] == role
+}
+
+func joinRequestTargets(evt *nostr.Event) ([]string, error) {
+	targets := make([]string, 0, len(evt.Tags)-1)
+	for _, tag := range evt.Tags.GetAll([]string{"p", ""}) {
+		if !nostr.IsValidPublicKeyHex(tag[1]) {
+			return nil, fmt.Errorf("invalid public key hex")
+		}
+		targets = append(targets, tag[1])
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("missing 'p' tags")
+	}
+	return targets, nil
+}
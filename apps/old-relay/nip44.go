@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NIP-44 version 2 encryption. go-nostr doesn't ship it in the version we're
+// on, so this follows https://github.com/nostr-protocol/nips/blob/master/44.md
+// with the primitives from x/crypto and btcec.
+
+const (
+	nip44Version    = 2
+	nip44MinPlain   = 1
+	nip44MaxPlain   = 65535
+	nip44NonceSize  = 32
+	nip44MacSize    = 32
+	nip44MinPayload = 1 + nip44NonceSize + 2 + 32 + nip44MacSize
+)
+
+var (
+	errNip44InvalidPayload = errors.New("nip44: invalid payload")
+	errNip44InvalidMac     = errors.New("nip44: invalid mac")
+	errNip44TooLong        = fmt.Errorf("nip44: plaintext can't be longer than %d bytes", nip44MaxPlain)
+)
+
+// nip44ConversationKey derives the key shared between the owner of privkey and
+// the owner of pubkey, both given as hex.
+func nip44ConversationKey(privkey string, pubkey string) ([]byte, error) {
+	skb, err := hex.DecodeString(privkey)
+	if err != nil || len(skb) != 32 {
+		return nil, fmt.Errorf("nip44: invalid private key")
+	}
+	pkb, err := hex.DecodeString("02" + pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("nip44: invalid public key")
+	}
+	pk, err := btcec.ParsePubKey(pkb)
+	if err != nil {
+		return nil, fmt.Errorf("nip44: invalid public key: %w", err)
+	}
+	var scalar btcec.ModNScalar
+	if overflow := scalar.SetByteSlice(skb); overflow || scalar.IsZero() {
+		return nil, fmt.Errorf("nip44: invalid private key")
+	}
+	sk := btcec.PrivKeyFromScalar(&scalar)
+
+	shared := btcec.GenerateSharedSecret(sk, pk)
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+func nip44Encrypt(plaintext string, conversationKey []byte) (string, error) {
+	nonce := make([]byte, nip44NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return nip44EncryptWithNonce(plaintext, conversationKey, nonce)
+}
+
+func nip44EncryptWithNonce(plaintext string, conversationKey []byte, nonce []byte) (string, error) {
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded, err := nip44Pad(plaintext)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := chacha20XOR(padded, chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, 0, 1+nip44NonceSize+len(ciphertext)+nip44MacSize)
+	payload = append(payload, nip44Version)
+	payload = append(payload, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = append(payload, nip44Mac(hmacKey, nonce, ciphertext)...)
+
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+func nip44Decrypt(payload string, conversationKey []byte) (string, error) {
+	if len(payload) == 0 || payload[0] == '#' {
+		return "", fmt.Errorf("nip44: unknown version")
+	}
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(raw) < nip44MinPayload {
+		return "", errNip44InvalidPayload
+	}
+	if raw[0] != nip44Version {
+		return "", fmt.Errorf("nip44: unknown version %d", raw[0])
+	}
+
+	nonce := raw[1 : 1+nip44NonceSize]
+	ciphertext := raw[1+nip44NonceSize : len(raw)-nip44MacSize]
+	mac := raw[len(raw)-nip44MacSize:]
+
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, nip44Mac(hmacKey, nonce, ciphertext)) {
+		return "", errNip44InvalidMac
+	}
+
+	padded, err := chacha20XOR(ciphertext, chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	return nip44Unpad(padded)
+}
+
+func nip44MessageKeys(conversationKey []byte, nonce []byte) (chachaKey, chachaNonce, hmacKey []byte, err error) {
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+func nip44Mac(hmacKey []byte, nonce []byte, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(nonce)
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
+
+func nip44PaddedLen(unpadded int) int {
+	if unpadded <= 32 {
+		return 32
+	}
+	nextPower := 1 << bits.Len(uint(unpadded-1))
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((unpadded-1)/chunk + 1)
+}
+
+func nip44Pad(plaintext string) ([]byte, error) {
+	if len(plaintext) > nip44MaxPlain {
+		return nil, errNip44TooLong
+	}
+	if len(plaintext) < nip44MinPlain {
+		return nil, fmt.Errorf("nip44: plaintext can't be empty")
+	}
+	padded := make([]byte, 2+nip44PaddedLen(len(plaintext)))
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+	return padded, nil
+}
+
+func nip44Unpad(padded []byte) (string, error) {
+	if len(padded) < 2 {
+		return "", errNip44InvalidPayload
+	}
+	unpadded := int(binary.BigEndian.Uint16(padded))
+	if unpadded < nip44MinPlain || len(padded) != 2+nip44PaddedLen(unpadded) {
+		return "", fmt.Errorf("nip44: invalid padding")
+	}
+	return string(padded[2 : 2+unpadded]), nil
+}
+
+// chacha20XOR is ChaCha20 starting at block counter 0, as NIP-44 uses it
+func chacha20XOR(src []byte, key []byte, nonce []byte) ([]byte, error) {
+	cipher, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, len(src))
+	cipher.XORKeyStream(dst, src)
+	return dst, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// the vectors below come from nip44.vectors.json in the NIP-44 spec
+
+func TestNip44ConversationKey(t *testing.T) {
+	for _, v := range []struct {
+		sec1            string
+		pub2            string
+		conversationKey string
+	}{
+		{
+			"315e59ff51cb9209768cf7da80791ddcaae56ac9775eb25b6dee1234bc5d2268",
+			"c2f9d9948dc8c7c38321e4b85c8558872eafa0641cd269db76848a6073e69133",
+			"3dfef0ce2a4d80a25e7a328accf73448ef67096f65f79588e358d9a0eb9013f1",
+		},
+		{
+			"a1e37752c9fdc1273be53f68c5f74be7c8905728e8de75800b94262f9497c86e",
+			"03bb7947065dde12ba991ea045132581d0954f042c84e06d8c00066e23c1a800",
+			"4d14f36e81b8452128da64fe6f1eae873baae2f444b02c950b90e43553f2178b",
+		},
+		{
+			"98a5902fd67518a0c900f0fb62158f278f94a21d6f9d33d30cd3091195500311",
+			"aae65c15f98e5e677b5050de82e3aba47a6fe49b3dab7863cf35d9478ba9f7d1",
+			"9c00b769d5f54d02bf175b7284a1cbd28b6911b06cda6666b2243561ac96bad7",
+		},
+	} {
+		key, err := nip44ConversationKey(v.sec1, v.pub2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != v.conversationKey {
+			t.Errorf("conversation key for %s: got %x, expected %s", v.sec1, key, v.conversationKey)
+		}
+	}
+
+	for _, v := range []struct {
+		sec1 string
+		pub2 string
+	}{
+		{strings.Repeat("f", 64), "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{strings.Repeat("0", 64), "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", strings.Repeat("f", 64)},
+		{"0000000000000000000000000000000000000000000000000000000000000001", strings.Repeat("0", 64)},
+	} {
+		if _, err := nip44ConversationKey(v.sec1, v.pub2); err == nil {
+			t.Errorf("got a conversation key for %s and %s", v.sec1, v.pub2)
+		}
+	}
+}
+
+func TestNip44EncryptDecrypt(t *testing.T) {
+	for _, v := range []struct {
+		sec1            string
+		sec2            string
+		conversationKey string
+		nonce           string
+		plaintext       string
+		payload         string
+	}{
+		{
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"0000000000000000000000000000000000000000000000000000000000000002",
+			"c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"a",
+			"AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000002",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d",
+			"f00000000000000000000000000000f00000000000000000000000000000000f",
+			"🍕🫃",
+			"AvAAAAAAAAAAAAAAAAAAAPAAAAAAAAAAAAAAAAAAAAAPSKSK6is9ngkX2+cSq85Th16oRTISAOfhStnixqZziKMDvB0QQzgFZdjLTPicCJaV8nDITO+QfaQ61+KbWQIOO2Yj",
+		},
+		{
+			"5c0c523f52a5b6fad39ed2403092df8cebc36318b39383bca6c00808626fab3a",
+			"4b22aa260e4acb7021e32f38a6cdf4b673c6a277755bfce287e370c924dc936d",
+			"3e2b52a63be47d34fe0a80e34e73d436d6963bc8f39827f327057a9986c20a45",
+			"b635236c42db20f021bb8d1cdff5ca75dd1a0cc72ea742ad750f33010b24f73b",
+			"表ポあA鷗ŒéＢ逍Üßªąñ丂㐀𠀀",
+			"ArY1I2xC2yDwIbuNHN/1ynXdGgzHLqdCrXUPMwELJPc7s7JqlCMJBAIIjfkpHReBPXeoMCyuClwgbT419jUWU1PwaNl4FEQYKCDKVJz+97Mp3K+Q2YGa77B6gpxB/lr1QgoqpDf7wDVrDmOqGoiPjWDqy8KzLueKDcm9BVP8xeTJIxs=",
+		},
+	} {
+		pub2, _ := nostr.GetPublicKey(v.sec2)
+		key, err := nip44ConversationKey(v.sec1, pub2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != v.conversationKey {
+			t.Fatalf("conversation key: got %x, expected %s", key, v.conversationKey)
+		}
+
+		nonce, _ := hex.DecodeString(v.nonce)
+		payload, err := nip44EncryptWithNonce(v.plaintext, key, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload != v.payload {
+			t.Errorf("encrypting %q: got %s, expected %s", v.plaintext, payload, v.payload)
+		}
+
+		// and the other side gets the same key and reads it back
+		pub1, _ := nostr.GetPublicKey(v.sec1)
+		otherKey, err := nip44ConversationKey(v.sec2, pub1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := nip44Decrypt(v.payload, otherKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext != v.plaintext {
+			t.Errorf("decrypting %s: got %q, expected %q", v.payload, plaintext, v.plaintext)
+		}
+	}
+}
+
+func TestNip44PaddedLength(t *testing.T) {
+	for _, v := range [][2]int{
+		{16, 32}, {32, 32}, {33, 64}, {37, 64}, {45, 64}, {49, 64}, {64, 64},
+		{65, 96}, {100, 128}, {111, 128}, {200, 224}, {250, 256}, {320, 320},
+		{383, 384}, {384, 384}, {400, 448}, {500, 512}, {512, 512}, {515, 640},
+		{700, 768}, {800, 896}, {900, 1024}, {1020, 1024}, {65536, 65536},
+	} {
+		if padded := nip44PaddedLen(v[0]); padded != v[1] {
+			t.Errorf("padded length of %d: got %d, expected %d", v[0], padded, v[1])
+		}
+	}
+}
+
+func TestNip44InvalidMessages(t *testing.T) {
+	key, _ := hex.DecodeString("c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d")
+
+	for _, length := range []int{0, 65536, 100000, 10000000} {
+		if _, err := nip44Encrypt(strings.Repeat("a", length), key); err == nil {
+			t.Errorf("encrypted a message with %d bytes", length)
+		}
+	}
+	if _, err := nip44Encrypt(strings.Repeat("a", 65536), key); !errors.Is(err, errNip44TooLong) {
+		t.Errorf("expected a too long error, got %v", err)
+	}
+
+	payload := "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb"
+	for name, invalid := range map[string]string{
+		"unknown version": "#" + payload[1:],
+		"bad base64":      payload[:40] + "!" + payload[41:],
+		"too short":       payload[:60],
+		"tampered":        payload[:50] + "B" + payload[51:],
+		"wrong version":   "Aw" + payload[2:],
+	} {
+		if _, err := nip44Decrypt(invalid, key); err == nil {
+			t.Errorf("%s: decrypted an invalid payload", name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// NIP-98 HTTP auth, which go-nostr doesn't have in the version we're on.
+// Requests carry "Authorization: Nostr <base64 of a kind 27235 event>" where
+// the event was signed just now for this url and method and, when there is a
+// body, commits to it with a "payload" tag holding its sha256. Each event is
+// only accepted once, so a request that was seen can't be replayed.
+
+const nip98MaxSkew = 60
+
+var (
+	// ids of the authorization events accepted, until they expire
+	nip98Seen      = make(map[string]nostr.Timestamp)
+	nip98SeenMutex sync.Mutex
+)
+
+// validateNIP98 returns the pubkey that signed the request. body is the request
+// body, which has already been read by the caller.
+func validateNIP98(r *http.Request, body []byte) (pubkey string, err error) {
+	header := r.Header.Get("Authorization")
+	encoded, ok := strings.CutPrefix(header, "Nostr ")
+	if !ok {
+		return "", fmt.Errorf("missing nostr authorization")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization encoding")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return "", fmt.Errorf("invalid authorization event")
+	}
+	if evt.Kind != 27235 {
+		return "", fmt.Errorf("authorization event has the wrong kind")
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok || evt.ID != evt.GetID() {
+		return "", fmt.Errorf("authorization event has an invalid signature")
+	}
+	if skew := nostr.Now() - evt.CreatedAt; skew > nip98MaxSkew || skew < -nip98MaxSkew {
+		return "", fmt.Errorf("authorization event is too old or too new")
+	}
+
+	uTag := evt.Tags.GetFirst([]string{"u", ""})
+	if uTag == nil || !sameRequestURL((*uTag)[1], r) {
+		return "", fmt.Errorf("authorization event is for another url")
+	}
+	methodTag := evt.Tags.GetFirst([]string{"method", ""})
+	if methodTag == nil || !strings.EqualFold((*methodTag)[1], r.Method) {
+		return "", fmt.Errorf("authorization event is for another method")
+	}
+
+	payloadTag := evt.Tags.GetFirst([]string{"payload", ""})
+	if len(body) > 0 && payloadTag == nil {
+		return "", fmt.Errorf("authorization event doesn't commit to the body")
+	}
+	if payloadTag != nil {
+		hash := sha256.Sum256(body)
+		if !strings.EqualFold((*payloadTag)[1], hex.EncodeToString(hash[:])) {
+			return "", fmt.Errorf("authorization event is for another body")
+		}
+	}
+
+	if !markNIP98Seen(&evt) {
+		return "", fmt.Errorf("authorization event was already used")
+	}
+
+	return evt.PubKey, nil
+}
+
+// markNIP98Seen records an authorization event as used until it's too old to be
+// accepted anyway. It returns false if it already was.
+func markNIP98Seen(evt *nostr.Event) bool {
+	nip98SeenMutex.Lock()
+	defer nip98SeenMutex.Unlock()
+
+	now := nostr.Now()
+	for id, expiration := range nip98Seen {
+		if expiration < now {
+			delete(nip98Seen, id)
+		}
+	}
+
+	if _, ok := nip98Seen[evt.ID]; ok {
+		return false
+	}
+	nip98Seen[evt.ID] = evt.CreatedAt + nip98MaxSkew
+	return true
+}
+
+// sameRequestURL compares a url from an authorization event with the one the
+// request was made to, ignoring the scheme since we may be behind a proxy and
+// clients may sign the relay's ws:// url. The host a proxy says it was asked
+// for is only used when the request comes from one of TrustedProxies.
+func sameRequestURL(signed string, r *http.Request) bool {
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" && isTrustedProxy(r.RemoteAddr) {
+		host = forwarded
+	}
+	requested := host + r.URL.Path
+
+	if _, rest, ok := strings.Cut(signed, "://"); ok {
+		signed = rest
+	}
+	return strings.TrimRight(signed, "/") == strings.TrimRight(requested, "/")
+}
+
+func isTrustedProxy(remoteAddr string) bool {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	return slices.Contains(s.TrustedProxies, ip)
+}
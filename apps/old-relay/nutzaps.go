@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// NIP-61 nutzaps.
+//
+// Creators announce the mints they accept and the pubkey ecash sent to them
+// must be locked to with a kind 10019. Subscribers pay by nutzapping the creator
+// (kind 9321) with proofs from one of those mints, tagging the creator with "p",
+// the group with "h" when it isn't the creator's own, and optionally their kind
+// 7001 with "e". Nutzaps are summed with tallyPayment.
+
+// MintList is a parsed kind 10019
+type MintList struct {
+	Mints []string
+	// the key proofs must be P2PK locked to, compressed and hex encoded
+	Pubkey string
+}
+
+// serializes the recording of the proofs we've seen
+var nutzapsMutex sync.Mutex
+
+func loadMintList(ctx context.Context, pubkey string) (*MintList, error) {
+	vrelay := eventstore.RelayWrapper{Store: db}
+	res, err := vrelay.QuerySync(ctx, nostr.Filter{Kinds: []int{10019}, Authors: []string{pubkey}, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("recipient has no mint list")
+	}
+
+	list := &MintList{}
+	for _, tag := range res[0].Tags.GetAll([]string{"mint", ""}) {
+		list.Mints = append(list.Mints, normalizeMintURL(tag[1]))
+	}
+
+	// the announced key is usually a nostr (x-only) pubkey, NIP-61 says to lock
+	// to it with the "02" prefix
+	list.Pubkey = "02" + pubkey
+	if tag := res[0].Tags.GetFirst([]string{"pubkey", ""}); tag != nil {
+		list.Pubkey = strings.ToLower((*tag)[1])
+		if len(list.Pubkey) == 64 {
+			list.Pubkey = "02" + list.Pubkey
+		}
+	}
+
+	return list, nil
+}
+
+// proofKey identifies a proof no matter how it was re-encoded: Y = hash_to_curve(secret)
+func proofKey(proof CashuProof) (string, error) {
+	y, err := hashToCurve([]byte(proof.Secret))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(y.SerializeCompressed()), nil
+}
+
+// verifyNutzap checks everything about a nutzap that can be checked without the
+// mint and returns the recipient and the proofs with their total in sats.
+func verifyNutzap(ctx context.Context, event *nostr.Event) (recipient string, proofs []CashuProof, sats int64, err error) {
+	pTag := event.Tags.GetFirst([]string{"p", ""})
+	if pTag == nil || !nostr.IsValidPublicKeyHex((*pTag)[1]) {
+		return "", nil, 0, fmt.Errorf("missing recipient ('p') tag")
+	}
+	recipient = (*pTag)[1]
+
+	uTag := event.Tags.GetFirst([]string{"u", ""})
+	if uTag == nil {
+		return "", nil, 0, fmt.Errorf("missing mint ('u') tag")
+	}
+	mint := normalizeMintURL((*uTag)[1])
+
+	mintList, err := loadMintList(ctx, recipient)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if !slices.Contains(mintList.Mints, mint) {
+		return "", nil, 0, fmt.Errorf("recipient doesn't accept ecash from %s", mint)
+	}
+	keysets, ok := mintKeysets[mint]
+	if !ok {
+		return "", nil, 0, fmt.Errorf("we don't know the keys of %s", mint)
+	}
+
+	// the same proof twice in one nutzap would count twice otherwise
+	seen := make(map[string]struct{})
+	for _, tag := range event.Tags.GetAll([]string{"proof", ""}) {
+		var proof CashuProof
+		if err := json.Unmarshal([]byte(tag[1]), &proof); err != nil {
+			return "", nil, 0, fmt.Errorf("invalid proof: %w", err)
+		}
+
+		keyset, ok := keysets[proof.ID]
+		if !ok {
+			return "", nil, 0, fmt.Errorf("unknown keyset '%s'", proof.ID)
+		}
+		if keyset.Unit != "sat" {
+			return "", nil, 0, fmt.Errorf("unsupported unit '%s'", keyset.Unit)
+		}
+		mintKey, ok := keyset.Keys[proof.Amount]
+		if !ok {
+			return "", nil, 0, fmt.Errorf("keyset '%s' has no key for %d", keyset.ID, proof.Amount)
+		}
+
+		key, err := proofKey(proof)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if _, ok := seen[key]; ok {
+			return "", nil, 0, fmt.Errorf("proof repeated within the nutzap")
+		}
+		seen[key] = struct{}{}
+
+		lock, err := p2pkLock(proof.Secret)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if lock != mintList.Pubkey {
+			return "", nil, 0, fmt.Errorf("proof isn't locked to the recipient")
+		}
+
+		if err := verifyProofDLEQ(proof, mintKey); err != nil {
+			return "", nil, 0, err
+		}
+
+		proofs = append(proofs, proof)
+		sats += int64(proof.Amount)
+	}
+	if len(proofs) == 0 {
+		return "", nil, 0, fmt.Errorf("nutzap without proofs")
+	}
+
+	return recipient, proofs, sats, nil
+}
+
+// validateNutzaps rejects nutzaps with proofs we can't verify or that were
+// already used in another nutzap, and the ones for a group the recipient can't
+// sell memberships to.
+func validateNutzaps(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.Kind != 9321 {
+		return false, ""
+	}
+
+	recipient, proofs, _, err := verifyNutzap(ctx, event)
+	if err != nil {
+		return true, "invalid: " + err.Error()
+	}
+	if groupId := getGroupIdFromEvent(event, "h"); groupId != "" {
+		if err := canSellMemberships(ctx, recipient, groupId); err != nil {
+			return true, "invalid: " + err.Error()
+		}
+	}
+
+	for _, proof := range proofs {
+		key, err := proofKey(proof)
+		if err != nil {
+			return true, "invalid: " + err.Error()
+		}
+		if found, err := state.Get("nutzap-proofs", key, new(string)); err != nil {
+			return true, "error: failed to check proofs"
+		} else if found {
+			return true, "duplicate: proof was already sent"
+		}
+	}
+
+	return false, ""
+}
+
+// ingestNutzap adds nutzaps, which have already been validated by
+// validateNutzaps, to the tally of the subscription they pay for: the one they
+// reference or else the sender's latest one to the recipient.
+func ingestNutzap(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 9321 {
+		return
+	}
+
+	recipient, proofs, sats, err := verifyNutzap(ctx, event)
+	if err != nil {
+		log.Warn().Err(err).Str("nutzap", event.ID).Msg("saved an invalid nutzap")
+		return
+	}
+
+	var refs []string
+	for _, tag := range event.Tags.GetAll([]string{"e", ""}) {
+		refs = append(refs, tag[1])
+	}
+	sub, err := findSubscription(ctx, event.PubKey, recipient, refs)
+	if err != nil {
+		log.Info().Err(err).Str("nutzap", event.ID).Msg("nutzap isn't for a subscription")
+		return
+	}
+	if groupId := getGroupIdFromEvent(event, "h"); groupId != "" && groupId != sub.GroupID {
+		log.Warn().Str("nutzap", event.ID).Str("group", groupId).Msg("nutzap for another group than its subscription")
+		return
+	}
+
+	if fresh, err := recordNutzapProofs(event, proofs); err != nil {
+		log.Error().Err(err).Str("nutzap", event.ID).Msg("failed to record nutzap proofs")
+		return
+	} else if !fresh {
+		log.Warn().Str("nutzap", event.ID).Msg("nutzap reuses proofs, not counting it")
+		return
+	}
+
+	payment, err := tallyPayment(sub, event.ID, sats, "nutzap")
+	if err != nil {
+		log.Error().Err(err).Str("nutzap", event.ID).Msg("failed to tally nutzap")
+		return
+	}
+	if payment == nil {
+		return
+	}
+
+	if err := creditPayment(ctx, *payment); err != nil {
+		log.Warn().Err(err).Str("nutzap", event.ID).Msg("failed to credit nutzaps")
+	}
+}
+
+// recordNutzapProofs marks the proofs of a nutzap as used. It returns false
+// without recording anything if any of them already was, in this nutzap or
+// another one.
+func recordNutzapProofs(event *nostr.Event, proofs []CashuProof) (fresh bool, err error) {
+	nutzapsMutex.Lock()
+	defer nutzapsMutex.Unlock()
+
+	keys := make([]string, 0, len(proofs))
+	seen := make(map[string]struct{}, len(proofs))
+	for _, proof := range proofs {
+		key, err := proofKey(proof)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := seen[key]; ok {
+			return false, nil
+		}
+		seen[key] = struct{}{}
+		if found, err := state.Get("nutzap-proofs", key, new(string)); err != nil {
+			return false, err
+		} else if found {
+			return false, nil
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if err := state.Put("nutzap-proofs", key, event.ID); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
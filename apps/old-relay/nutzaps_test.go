@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testdata/nutzaps.jsonl has a creator's mint list (10019) and "gold" tier, a
+// subscription to it, and nutzaps paying for it with proofs minted by the
+// keyset in testdata/mints, each with its DLEQ proof. The nutzaps are told
+// apart by their content:
+//
+//   - "doubled" has the same 16 sat proof twice
+//   - "hijack" is for a group the creator doesn't run
+//   - "pays" has 16 + 8 sats, which cover the 21 sats of the tier
+//   - "reused" sends the 8 sats proof of "pays" again, with a new 4 sats one
+const (
+	nutzapCreator    = "79a260fa4dd9ad9b500f76f9b4d3483843ae1f0031e9c55efdfb3681883faab5"
+	nutzapSubscriber = "bcec4f9aa8dcfa3e7ac2517dcbdf273d0bfcd67a702f79ff3bbebf34f048ae6e"
+)
+
+func loadNutzapFixtures(t *testing.T) map[string]*nostr.Event {
+	t.Helper()
+
+	previous := mintKeysets
+	mintKeysets = make(map[string]map[string]*mintKeyset)
+	t.Cleanup(func() { mintKeysets = previous })
+	if err := loadMintKeysets("testdata/mints"); err != nil {
+		t.Fatal(err)
+	}
+
+	nutzaps := make(map[string]*nostr.Event)
+	for _, event := range loadFixtureLog(t, "testdata/nutzaps.jsonl") {
+		if event.Kind == 9321 {
+			nutzaps[event.Content] = event
+		}
+	}
+	return nutzaps
+}
+
+func nutzapProofs(t *testing.T, event *nostr.Event) []CashuProof {
+	t.Helper()
+
+	var proofs []CashuProof
+	for _, tag := range event.Tags.GetAll([]string{"proof", ""}) {
+		var proof CashuProof
+		if err := json.Unmarshal([]byte(tag[1]), &proof); err != nil {
+			t.Fatal(err)
+		}
+		proofs = append(proofs, proof)
+	}
+	return proofs
+}
+
+func TestNutzapsPayForSubscriptions(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	nutzaps := loadNutzapFixtures(t)
+
+	if reject, msg := validateNutzaps(ctx, nutzaps["pays"]); reject {
+		t.Fatalf("valid nutzap rejected: %s", msg)
+	}
+	ingestNutzap(ctx, nutzaps["pays"])
+
+	memberships, err := loadPaidMemberships(nutzapCreator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships) != 1 || memberships[0].Pubkey != nutzapSubscriber || memberships[0].Tier != "gold" {
+		t.Fatalf("expected a gold membership for the subscriber, got %v", memberships)
+	}
+
+	// its proofs are spent now
+	if reject, msg := validateNutzaps(ctx, nutzaps["reused"]); !reject || !strings.HasPrefix(msg, "duplicate:") {
+		t.Errorf("nutzap reusing proofs wasn't rejected as a duplicate: %s", msg)
+	}
+}
+
+func TestNutzapWithRepeatedProofs(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	nutzaps := loadNutzapFixtures(t)
+	doubled := nutzaps["doubled"]
+
+	if reject, msg := validateNutzaps(ctx, doubled); !reject || !strings.Contains(msg, "repeated") {
+		t.Fatalf("nutzap with a repeated proof wasn't rejected: %s", msg)
+	}
+
+	// had it been stored anyway, it would neither be credited
+	ingestNutzap(ctx, doubled)
+	if memberships, err := loadPaidMemberships(nutzapCreator); err != nil {
+		t.Fatal(err)
+	} else if len(memberships) != 0 {
+		t.Fatalf("one 16 sats proof sent twice paid for a 21 sats tier: %v", memberships)
+	}
+
+	// nor have its proofs recorded
+	proofs := nutzapProofs(t, doubled)
+	if fresh, err := recordNutzapProofs(doubled, proofs); err != nil {
+		t.Fatal(err)
+	} else if fresh {
+		t.Fatal("repeated proofs recorded as fresh")
+	}
+	if fresh, err := recordNutzapProofs(doubled, proofs[:1]); err != nil || !fresh {
+		t.Fatalf("the proof should still be unspent: %v", err)
+	}
+}
+
+func TestNutzapForAnotherGroup(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	nutzaps := loadNutzapFixtures(t)
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := createGroup(ctx, "victim", owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reject, msg := validateNutzaps(ctx, nutzaps["hijack"]); !reject || !strings.Contains(msg, "admin") {
+		t.Fatalf("nutzap for a group the recipient doesn't run wasn't rejected: %s", msg)
+	}
+}
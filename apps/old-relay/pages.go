@@ -4,21 +4,99 @@ import (
 	. "github.com/theplant/htmlgo"
 )
 
+// the page is self-contained: no external stylesheets, scripts or fonts
+const homepageStyle = `
+body { font-family: system-ui, sans-serif; margin: 1.5rem 1rem; max-width: 40rem; color: #1c1917; }
+h1 { font-size: 1.25rem; margin-bottom: 0.5rem; }
+label { display: block; margin-top: 0.75rem; }
+input[type=text], textarea { box-sizing: border-box; width: 100%; padding: 0.5rem 1rem; border: 0; background: #f5f5f4; }
+textarea { height: 5rem; font-family: monospace; }
+.checks label { display: inline-block; margin-right: 1rem; }
+button { margin-top: 1rem; border: 0; border-radius: 0.25rem; padding: 0.5rem 1rem; background: #10b981; color: white; cursor: pointer; }
+button:hover { background: #6ee7b7; }
+pre { white-space: pre-wrap; word-break: break-all; }
+`
+
+// homepageScript signs the tiers and the NIP-98 authorization of the request
+// with the visitor's NIP-07 extension, so the group is owned by them.
+const homepageScript = `
+async function sha256hex(text) {
+  const hash = await crypto.subtle.digest('SHA-256', new TextEncoder().encode(text))
+  return Array.from(new Uint8Array(hash)).map(b => b.toString(16).padStart(2, '0')).join('')
+}
+
+document.getElementById('create').addEventListener('submit', async (ev) => {
+  ev.preventDefault()
+  const result = document.getElementById('result')
+  const value = id => document.getElementById(id).value.trim()
+  if (!window.nostr) {
+    result.textContent = 'a nostr signer extension (NIP-07) is needed to create a group'
+    return
+  }
+
+  try {
+    const now = () => Math.floor(Date.now() / 1000)
+    const tiers = []
+    for (const line of value('tiers').split('\n')) {
+      const [id, amount, currency, cadence] = line.trim().split(/\s+/)
+      if (!id) continue
+      tiers.push(await window.nostr.signEvent({
+        kind: 37001, created_at: now(), content: '',
+        tags: [['d', id], ['title', id], ['amount', amount || '', currency || 'sat', cadence || 'monthly']],
+      }))
+    }
+
+    const body = JSON.stringify({
+      name: value('name'), about: value('about'), picture: value('picture'),
+      private: document.getElementById('private').checked,
+      closed: document.getElementById('closed').checked,
+      tiers,
+    })
+    const auth = await window.nostr.signEvent({
+      kind: 27235, created_at: now(), content: '',
+      tags: [['u', location.origin + '/create'], ['method', 'POST'], ['payload', await sha256hex(body)]],
+    })
+
+    const res = await fetch('/create', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json', 'Authorization': 'Nostr ' + btoa(JSON.stringify(auth)) },
+      body,
+    })
+    const data = await res.json()
+    result.textContent = res.ok ? 'group created!\n\n' + data.naddr : data.error
+  } catch (err) {
+    result.textContent = String(err)
+  }
+})
+`
+
 func homepageHTML() HTMLComponent {
 	return HTML(
 		Head(
 			Meta().Charset("utf-8"),
 			Meta().Name("viewport").Content("width=device-width, initial-scale=1"),
 			Title(s.RelayName),
-			Script("").Src("https://cdn.tailwindcss.com"),
+			Style(homepageStyle),
 		),
 		Body(
-			H1("create a group").Class("text-xl mb-2"),
+			H1("create a group"),
 			Form(
-				Label("group owner:").For("npub").Class("mr-1"),
-				Input("").Id("npub").Placeholder("npub1...").Name("pubkey").Class("w-96 px-4 py-2 outline-0 bg-stone-100"),
-				Button("create").Class("rounded px-4 py-2 bg-emerald-500 text-white hover:bg-emerald-300 transition-colors"),
-			).Action("/create").Method("POST"),
-		).Class("mx-4 my-6"),
+				Label("name").For("name"),
+				Input("name").Id("name").Type("text"),
+				Label("about").For("about"),
+				Input("about").Id("about").Type("text"),
+				Label("picture url").For("picture"),
+				Input("picture").Id("picture").Type("text").Placeholder("https://..."),
+				Div(
+					Label("").Children(Input("private").Id("private").Type("checkbox"), Text(" private")),
+					Label("").Children(Input("closed").Id("closed").Type("checkbox"), Text(" closed")),
+				).Class("checks"),
+				Label("tiers, one per line: id amount currency cadence").For("tiers"),
+				Textarea("").Id("tiers").Name("tiers").Placeholder("supporter 5000 sat monthly"),
+				Button("create").Type("submit"),
+			).Id("create"),
+			Pre("").Id("result"),
+			Script(homepageScript),
+		),
 	)
 }
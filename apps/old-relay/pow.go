@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// powDifficulty is the NIP-13 difficulty events sent to an open group must
+// have. The group setting replaces the default, and kind settings can only
+// raise it, so join requests can cost more than regular posts. Zero means no
+// proof of work is needed.
+func powDifficulty(groupId string, kind int) int {
+	difficulty := s.PowDifficulty
+	if d, ok := s.PowDifficultyByGroup[groupId]; ok {
+		difficulty = d
+	}
+	if d, ok := s.PowDifficultyByKind[kind]; ok && d > difficulty {
+		difficulty = d
+	}
+	return difficulty
+}
+
+// requiresProofOfWork tells if any of the difficulty settings is above 0
+func requiresProofOfWork() bool {
+	if s.PowDifficulty > 0 {
+		return true
+	}
+	for _, difficulty := range s.PowDifficultyByKind {
+		if difficulty > 0 {
+			return true
+		}
+	}
+	for _, difficulty := range s.PowDifficultyByGroup {
+		if difficulty > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireProofOfWork rejects events to open groups that don't have enough
+// proof of work. Closed groups already vet who gets in, and admins and the
+// relay are trusted. A group that doesn't exist yet is as open as it gets, so
+// creating one costs the same as posting to one.
+func requireProofOfWork(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	groupId := getGroupIdFromEvent(event, "h")
+	if groupId == "" || event.PubKey == s.RelayPubkey {
+		return false, ""
+	}
+
+	difficulty := powDifficulty(groupId, event.Kind)
+	if difficulty <= 0 {
+		return false, ""
+	}
+
+	group := groups.Snapshot(ctx, groupId, false)
+	if group != nil {
+		if group.Closed {
+			return false, ""
+		}
+		if role, isMember := group.Members[event.PubKey]; isMember && role != emptyRole {
+			return false, ""
+		}
+	}
+
+	if err := nip13.Check(event.ID, difficulty); err != nil {
+		return true, fmt.Sprintf("pow: difficulty %d is needed", difficulty)
+	}
+
+	// a lucky id doesn't count if the author was aiming lower
+	if tag := event.Tags.GetFirst([]string{"nonce", "", ""}); tag != nil {
+		if target, err := strconv.Atoi((*tag)[2]); err != nil || target < difficulty {
+			return true, fmt.Sprintf("pow: committed target is below %d", difficulty)
+		}
+	}
+
+	return false, ""
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+func TestProofOfWorkForGroupsThatDontExistYet(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	s.PowDifficulty = 8
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	// creating a group is held to the same difficulty as posting to an open one
+	create := signEvent(t, sk, 9007, nostr.Now(), nostr.Tags{{"h", "new-group"}}, "")
+	for nip13.Difficulty(create.ID) >= 8 {
+		create = signEvent(t, sk, 9007, create.CreatedAt+1, create.Tags, "")
+	}
+	if reject, _ := requireProofOfWork(ctx, create); !reject {
+		t.Fatal("a group creation without proof of work was let through")
+	}
+
+	mined := &nostr.Event{PubKey: pubkey, Kind: 9007, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"h", "new-group"}}}
+	mined, err := nip13.Generate(mined, 8, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mined.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if reject, msg := requireProofOfWork(ctx, mined); reject {
+		t.Fatalf("a group creation with enough proof of work was rejected: %s", msg)
+	}
+
+	// closed groups vet their members instead
+	if err := createGroup(ctx, pubkey, pubkey, GroupSetup{Closed: true}); err != nil {
+		t.Fatal(err)
+	}
+	other := nostr.GeneratePrivateKey()
+	post := signEvent(t, other, 9, nostr.Now(), nostr.Tags{{"h", pubkey}}, "hi")
+	if reject, msg := requireProofOfWork(ctx, post); reject {
+		t.Fatalf("an event to a closed group needed proof of work: %s", msg)
+	}
+}
+
+func TestPowDifficultiesAreAdvertised(t *testing.T) {
+	setupTestRelay(t)
+	s.PowDifficulty = 8
+	s.PowDifficultyByKind = map[int]int{9021: 20}
+	s.PowDifficultyByGroup = map[string]int{"quiet": 0}
+	if err := initRelayInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	limitation := relayInformation().Limitation
+	if limitation.MinPowDifficulty != 8 {
+		t.Fatalf("expected the default difficulty of 8, got %d", limitation.MinPowDifficulty)
+	}
+	if d, ok := limitation.PowDifficulties["kind:9021"]; !ok || d != 20 {
+		t.Fatalf("join requests should advertise a difficulty of 20, got %v", limitation.PowDifficulties)
+	}
+	if d, ok := limitation.PowDifficulties["group:quiet"]; !ok || d != 0 {
+		t.Fatalf("the group override should be advertised, got %v", limitation.PowDifficulties)
+	}
+}
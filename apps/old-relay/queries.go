@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
@@ -28,41 +27,94 @@ func getTiersFromEvent(event *nostr.Event) []string {
 
 /**
  * Sends the event to the channel. If this is a members-only
- * event, it strips the signature
+ * event, it strips the signature, and if its content was stored
+ * encrypted, it gets encrypted to the requester.
  */
 func sendEvent(ch chan *nostr.Event, event *nostr.Event, requesterPubkey string) {
-	tiers := getTiersFromEvent(event)
-	if len(tiers) > 0 {
-		if !slices.Contains(tiers, "Free") {
-			if requesterPubkey == event.PubKey {
-				fmt.Println("event is members-only, but requester is the author, not stripping signature")
-			} else {
-				fmt.Println("stripping signature from event")
-				event.Sig = ""
+	if !prepareSealedEvent(event, requesterPubkey) {
+		return
+	}
+
+	if isGated(event) && requesterPubkey != event.PubKey {
+		event.Sig = ""
+	}
+
+	ch <- event
+}
+
+// prepareBroadcast gets an event that was just published ready for the live
+// subscriptions it matches. khatru sends the same copy to all of them, so it
+// has to be fit for anyone, as if nobody had authenticated: gated content is
+// stripped and long-form content is preceded by its teaser. Entitled readers
+// get the full version when they query for it. Invites and join requests are
+// only for admins (and whoever asked to join), so everyone else just sees that
+// there was one, without its code or message.
+//
+// khatru calls this for the events sent in reply to REQs too, which our query
+// handlers have already prepared for their reader.
+func prepareBroadcast(ctx context.Context, event *nostr.Event) {
+	if subscriptionID(ctx) != "" {
+		return
+	}
+
+	if event.Kind == 9009 || event.Kind == 9021 {
+		tags := make(nostr.Tags, 0, len(event.Tags))
+		for _, tag := range event.Tags {
+			if len(tag) == 0 || tag[0] != "code" {
+				tags = append(tags, tag)
 			}
-		} else {
-			fmt.Println("event is free, not stripping signature", tiers)
 		}
+		event.Tags = tags
+		event.Content = ""
+		event.Sig = ""
+		return
 	}
 
-	ch <- event
+	if decideAccess(AccessRequest{Event: event}) != AccessGranted {
+		if slices.Contains(contentKinds, event.Kind) {
+			if teaser, err := makeTeaser(event); err != nil {
+				log.Error().Err(err).Str("event", event.ID).Msg("failed to make teaser")
+			} else {
+				relay.BroadcastEvent(teaser)
+			}
+		}
+		event.Content = ""
+		event.Sig = ""
+	}
 }
 
-func contentQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+// authedPubkey is khatru.GetAuthed for contexts that may not come from a client
+// connection, like the ones our own background jobs use to add events. It also
+// lets notifyPubkey know who the connection is.
+func authedPubkey(ctx context.Context) string {
+	ws := clientConnection(ctx)
+	if ws == nil {
+		return ""
+	}
 	pubkey := khatru.GetAuthed(ctx)
+	if pubkey != "" {
+		rememberAuthedPubkey(ws, pubkey)
+	}
+	return pubkey
+}
 
-	var memberships []Membership
+func contentQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	// khatru looking up events for itself, nothing is sent to anyone. Deletions
+	// must find their targets even when whoever deletes can't read them
+	if subscriptionID(ctx) == "" {
+		return db.QueryEvents(ctx, filter)
+	}
 
-	fmt.Println("filter", filter)
+	pubkey := authedPubkey(ctx)
 
+	var memberships []Membership
 	if pubkey != "" {
 		memberships = loadMemberships(ctx, pubkey)
 	}
 
 	queryChannel, err := db.QueryEvents(ctx, filter)
-
 	if err != nil {
-		fmt.Println("error querying events", err)
+		return nil, err
 	}
 
 	retChannel := make(chan *nostr.Event, 500)
@@ -70,62 +122,53 @@ func contentQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.
 	go func() {
 		defer close(retChannel)
 
-		for event := range queryChannel {
-			eventTiers := getTiersFromEvent(event)
+		// join requests are only for the requester and the admins who handle them,
+		// invites only for the admins
+		groupsSeen := make(map[string]*Group)
+		now := nostr.Now()
 
-			// if there are no f tags, send the event
-			if len(eventTiers) == 0 {
-				sendEvent(retChannel, event, pubkey)
+		for event := range queryChannel {
+			// served by the group events handlers
+			if event.PubKey == s.RelayPubkey && slices.Contains(groupEventKinds, event.Kind) {
 				continue
 			}
 
-			groupId := groupIdFromEvent(event)
-
-			// if there is no h tag, send the event
-			if groupId == "" {
-				sendEvent(retChannel, event, pubkey)
-			}
-
-			tiers := getTiersFromMemberships(memberships, groupId)
-
-			// if the groupId is the pubkey, send the event
-			if groupId == pubkey {
-				fmt.Println("groupid is pubkey", event.Tags)
-
-				// if the tier has a "full" tag
-				if event.Tags.GetFirst([]string{"full", ""}) != nil {
-					dTag := event.Tags.GetFirst([]string{"d", ""})
-					// fmt.Println("event has full tag", "filter.Tags[d]", filter.Tags["d"], "dTag", dTag)
-
-					// only send the event if the d tag is in the filter
-					if dTag != nil && slices.Contains(filter.Tags["d"], (*dTag)[1]) {
-						// fmt.Println("d tag is in filter, sending event", event.Tags, "filter.Tags[d]", filter.Tags["d"])
-						sendEvent(retChannel, event, pubkey)
-						continue
-					} else {
-						// fmt.Println("d tag is not in filter, not sending event", event.Tags, "filter.Tags[d]", filter.Tags["d"])
-						continue
-					}
-				} else {
-					// if it does not have a "full" tag, send the event
-					// fmt.Println("event does not have full tag, sending it")
-					sendEvent(retChannel, event, pubkey)
+			if event.Kind == 9021 || event.Kind == 9009 {
+				groupId := getGroupIdFromEvent(event, "h")
+				group, ok := groupsSeen[groupId]
+				if !ok {
+					group = groups.Snapshot(ctx, groupId, false)
+					groupsSeen[groupId] = group
+				}
+				if event.Kind == 9021 && !canSeeJoinRequest(group, pubkey, event) {
 					continue
 				}
-			}
-
-			// if any tier is among the f tags, send the event
-			for _, tier := range tiers {
-				// fmt.Println("compare tier", tier, "with eventTiers", eventTiers)
-				if slices.Contains(eventTiers, tier) {
-					fmt.Println("tier is among eventTiers, sending event", tier, event.Tags)
-					sendEvent(retChannel, event, pubkey)
+				if event.Kind == 9009 && !canSeeInvite(group, pubkey) {
 					continue
 				}
 			}
 
-			// otherwise, don't send the event
-			// fmt.Println("not sending event", event.Tags.GetFirst([]string{"title"}), "subscribedTiers", tiers, "eventTiers", eventTiers, "pubkey = ", pubkey, "groupId =", groupId)
+			switch decideAccess(AccessRequest{
+				Requester:      pubkey,
+				Tiers:          requesterTiers(memberships, event, now),
+				Event:          event,
+				RequestedDTags: filter.Tags["d"],
+			}) {
+			case AccessGranted:
+				sendEvent(retChannel, event, pubkey)
+			case AccessDenied:
+				// long-form content gets a teaser instead. It stands in for the full
+				// version, so it answers whatever found that, even though being signed
+				// by the relay and having its own tags it may not match the filter
+				// itself (e.g. when asked for the author's articles or for their id)
+				if slices.Contains(contentKinds, event.Kind) {
+					if teaser, err := makeTeaser(event); err != nil {
+						log.Error().Err(err).Str("event", event.ID).Msg("failed to make teaser")
+					} else {
+						retChannel <- teaser
+					}
+				}
+			}
 		}
 	}()
 
@@ -133,141 +176,75 @@ func contentQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.
 }
 
 func metadataQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
-
-	if slices.Contains(filter.Kinds, 39000) {
-		go func() {
-			defer close(ch)
-
-			for _, groupId := range filter.Tags["d"] {
-				fmt.Println("loading group", groupId)
-				group := loadGroup(ctx, groupId, false)
-
-				if group == nil {
-					continue
-				}
-
-				evt := &nostr.Event{
-					Kind:      39000,
-					CreatedAt: nostr.Now(),
-					Content:   group.About,
-					Tags: nostr.Tags{
-						nostr.Tag{"d", group.ID},
-					},
-				}
-				if group.Name != "" {
-					evt.Tags = append(evt.Tags, nostr.Tag{"name", group.Name})
-				}
-				if group.Picture != "" {
-					evt.Tags = append(evt.Tags, nostr.Tag{"picture", group.Picture})
-				}
-
-				// status
-				if group.Private {
-					evt.Tags = append(evt.Tags, nostr.Tag{"private"})
-				} else {
-					evt.Tags = append(evt.Tags, nostr.Tag{"public"})
-				}
-				if group.Closed {
-					evt.Tags = append(evt.Tags, nostr.Tag{"closed"})
-				} else {
-					evt.Tags = append(evt.Tags, nostr.Tag{"open"})
-				}
-
-				// sign
-				evt.Sign(s.RelayPrivkey)
-				fmt.Println("sending metadata event", evt)
-				ch <- evt
-				fmt.Println("sent metadata event", evt)
-			}
-		}()
-	} else {
-		close(ch)
-	}
-	fmt.Println("closing metadata channel")
-	return ch, nil
+	return groupEventsQueryHandler(ctx, filter, 39000)
 }
 
 func adminsQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
-	if slices.Contains(filter.Kinds, 39001) {
-		go func() {
-			defer close(ch)
-			for _, groupId := range filter.Tags["d"] {
-				group := loadGroup(ctx, groupId, false)
-
-				if group == nil {
-					continue
-				}
-
-				evt := &nostr.Event{
-					Kind:      39001,
-					CreatedAt: nostr.Now(),
-					Content:   "list of admins for group " + groupId,
-					Tags: nostr.Tags{
-						nostr.Tag{"d", group.ID},
-					},
-				}
-				for pubkey, role := range group.Members {
-					if role != emptyRole && role != masterRole {
-						tag := nostr.Tag{pubkey, "admin"}
-						for permName := range role.Permissions {
-							tag = append(tag, permName)
-						}
-						evt.Tags = append(evt.Tags, tag)
-					}
-				}
-				evt.Sign(s.RelayPrivkey)
-				ch <- evt
-			}
-		}()
-	} else {
-		close(ch)
-	}
-	return ch, nil
+	return groupEventsQueryHandler(ctx, filter, 39001)
 }
 
 func membersQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
+	return groupEventsQueryHandler(ctx, filter, 39002)
+}
 
-	if slices.Contains(filter.Kinds, 39002) {
-		go func() {
-			defer close(ch)
-			for _, groupId := range filter.Tags["d"] {
-				group := loadGroup(ctx, groupId, false)
+// groupEventsQueryHandler serves the stored relay-signed event of the given
+// kind for every group in the filter. Without a "d" tag it lists every group,
+// newest first, leaving out the private ones the requester isn't a member of.
+func groupEventsQueryHandler(ctx context.Context, filter nostr.Filter, kind int) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event, 1)
+	if !slices.Contains(filter.Kinds, kind) {
+		close(ch)
+		return ch, nil
+	}
 
-				if group == nil {
-					continue
-				}
+	groupIds, discovery := filter.Tags["d"], false
+	if _, ok := filter.Tags["d"]; !ok {
+		ids, err := listGroupIds(ctx)
+		if err != nil {
+			close(ch)
+			return nil, err
+		}
+		groupIds, discovery = ids, true
+	}
 
-				evt := &nostr.Event{
-					Kind:      39002,
-					CreatedAt: nostr.Now(),
-					Content:   "list of members of " + groupId,
-					Tags: nostr.Tags{
-						nostr.Tag{"d", group.ID},
-					},
-				}
-				for pubkey, role := range group.Members {
-					if pubkey == s.RelayPubkey {
-						continue
-					}
+	go func() {
+		defer close(ch)
 
-					tag := nostr.Tag{"p", pubkey}
-					if role != emptyRole && role != masterRole {
-						for permName := range role.Permissions {
-							tag = append(tag, permName)
-						}
-					}
-					evt.Tags = append(evt.Tags, tag)
-				}
-				evt.Sign(s.RelayPrivkey)
-				ch <- evt
+		pubkey := authedPubkey(ctx)
+		events := make([]*nostr.Event, 0, len(groupIds))
+		for _, groupId := range groupIds {
+			evt := getGroupEvent(ctx, groupId, kind)
+			if evt == nil || !filter.Matches(evt) {
+				continue
 			}
-		}()
-	} else {
-		close(ch)
-	}
+			if discovery && !canDiscoverGroup(ctx, groupId, pubkey) {
+				continue
+			}
+			events = append(events, evt)
+		}
+
+		slices.SortFunc(events, func(a, b *nostr.Event) int { return int(b.CreatedAt - a.CreatedAt) })
+		if filter.Limit > 0 && len(events) > filter.Limit {
+			events = events[:filter.Limit]
+		}
+		for _, evt := range events {
+			ch <- evt
+		}
+	}()
 
 	return ch, nil
 }
+
+// canDiscoverGroup tells if a group shows up when listing groups: private ones
+// are only listed to their members
+func canDiscoverGroup(ctx context.Context, groupId string, pubkey string) bool {
+	group := groups.Snapshot(ctx, groupId, false)
+	if group == nil {
+		return false
+	}
+	if !group.Private {
+		return true
+	}
+	_, isMember := group.Members[pubkey]
+	return pubkey != "" && isMember
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/time/rate"
+)
+
+// Events go through layered token buckets: one per connection, per IP, per
+// author, per author and kind, and the group's own. An event has to fit in all
+// of them, so one spammer runs out of their own tokens long before they lock
+// everybody else out of a group. The relay and the owner and admins of the
+// group the event is for aren't limited.
+
+// RateLimit is written as "events/interval", like "15/2m". The zero value (or
+// an empty setting) means no limit.
+type RateLimit struct {
+	Events int
+	Per    time.Duration
+}
+
+func (rl *RateLimit) Decode(value string) error {
+	if value == "" {
+		*rl = RateLimit{}
+		return nil
+	}
+	events, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return fmt.Errorf("rate limit '%s' should look like 'events/interval'", value)
+	}
+	n, err := strconv.Atoi(events)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number of events in rate limit '%s'", value)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid interval in rate limit '%s'", value)
+	}
+	*rl = RateLimit{Events: n, Per: d}
+	return nil
+}
+
+func (rl RateLimit) String() string {
+	if rl.Events == 0 {
+		return ""
+	}
+	return strconv.Itoa(rl.Events) + "/" + rl.Per.String()
+}
+
+// newLimiter refills the whole bucket of events over the interval
+func (rl RateLimit) newLimiter() *rate.Limiter {
+	if rl.Events == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Every(rl.Per/time.Duration(rl.Events)), rl.Events)
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	per      time.Duration
+	lastUsed time.Time
+}
+
+// limiters holds the buckets of every layer but the group's, which lives with
+// the group unless the group doesn't exist. Idle ones are dropped by
+// sweepRateLimiters.
+var (
+	limiters      = make(map[string]*limiterEntry)
+	limitersMutex sync.Mutex
+)
+
+func getLimiter(key string, limit RateLimit) *rate.Limiter {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+
+	entry, ok := limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: limit.newLimiter(), per: limit.Per}
+		limiters[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	return entry.limiter
+}
+
+// sweepRateLimiters periodically forgets buckets that have been idle long
+// enough to be full again
+func sweepRateLimiters(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		limitersMutex.Lock()
+		for key, entry := range limiters {
+			if time.Since(entry.lastUsed) > entry.per {
+				delete(limiters, key)
+			}
+		}
+		limitersMutex.Unlock()
+	}
+}
+
+// connectionKey identifies the websocket the context comes from, if any
+func connectionKey(ctx context.Context) string {
+	if ws := clientConnection(ctx); ws != nil {
+		return fmt.Sprintf("%p", ws)
+	}
+	return ""
+}
+
+func rateLimit(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.PubKey == s.RelayPubkey {
+		return false, ""
+	}
+
+	groupId := getGroupIdFromEvent(event, "h")
+	var group *Group
+	if groupId != "" {
+		if event.PubKey == groupId {
+			// the owner of a creator group
+			return false, ""
+		}
+		group = groups.Snapshot(ctx, groupId, false)
+	}
+	if group != nil {
+		if role, isMember := group.Members[event.PubKey]; isMember && role != emptyRole {
+			return false, ""
+		}
+	}
+
+	// the author, or whoever is authenticated when sending someone else's event
+	pubkey := authedPubkey(ctx)
+	if pubkey == "" {
+		pubkey = event.PubKey
+	}
+
+	var buckets []*rate.Limiter
+	layer := func(key string, limit RateLimit) {
+		if key != "" && limit.Events > 0 {
+			buckets = append(buckets, getLimiter(key, limit))
+		}
+	}
+	if conn := connectionKey(ctx); conn != "" {
+		layer("conn:"+conn, s.RateLimitConnection)
+	}
+	if ip := connectionIP(ctx); ip != "" {
+		layer("ip:"+ip, s.RateLimitIP)
+	}
+	layer("pubkey:"+pubkey, s.RateLimitPubkey)
+	if limit, ok := s.RateLimitByKind[event.Kind]; ok {
+		layer("kind:"+strconv.Itoa(event.Kind)+":"+pubkey, limit)
+	}
+	if group != nil {
+		if group.bucket != nil {
+			buckets = append(buckets, group.bucket)
+		}
+	} else if groupId != "" {
+		// groups that don't exist (yet) aren't kept around, so their bucket is
+		// kept with the others
+		layer("group:"+groupId, s.RateLimitGroup)
+	}
+
+	// take a token from every bucket, or from none if any of them is empty
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(buckets))
+	var wait time.Duration
+	for _, bucket := range buckets {
+		rsv := bucket.ReserveN(now, 1)
+		reservations = append(reservations, rsv)
+		if delay := rsv.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait == 0 {
+		return false, ""
+	}
+	for _, rsv := range reservations {
+		rsv.CancelAt(now)
+	}
+
+	return true, fmt.Sprintf("rate-limited: slow down, try again in %ds", int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// noRateLimits turns every layer off, so a test can turn on the one it's about
+func noRateLimits() {
+	s.RateLimitConnection = RateLimit{}
+	s.RateLimitIP = RateLimit{}
+	s.RateLimitPubkey = RateLimit{}
+	s.RateLimitGroup = RateLimit{}
+	s.RateLimitByKind = nil
+}
+
+func isRateLimited(reject bool, msg string) bool {
+	return reject && strings.HasPrefix(msg, "rate-limited:")
+}
+
+func TestRateLimitPerConnectionAndIP(t *testing.T) {
+	url := startTestRelay(t)
+	noRateLimits()
+	s.RateLimitConnection = RateLimit{Events: 2, Per: time.Hour}
+
+	sk := nostr.GeneratePrivateKey()
+	client := connectTestClient(t, url, sk)
+	for i := 0; i < 2; i++ {
+		if ok, reason := client.publish(signEvent(t, sk, 1, nostr.Now(), nil, string(rune('a'+i)))); !ok {
+			t.Fatal(reason)
+		}
+	}
+	if ok, reason := client.publish(signEvent(t, sk, 1, nostr.Now(), nil, "c")); ok || !strings.HasPrefix(reason, "rate-limited:") {
+		t.Fatalf("a third event on the connection got through: %s", reason)
+	}
+
+	// the same author on another connection has a bucket of their own
+	if ok, reason := connectTestClient(t, url, sk).publish(signEvent(t, sk, 1, nostr.Now(), nil, "d")); !ok {
+		t.Fatalf("another connection was limited: %s", reason)
+	}
+
+	// every connection comes from the same IP here
+	s.RateLimitConnection = RateLimit{}
+	s.RateLimitIP = RateLimit{Events: 1, Per: time.Hour}
+	if ok, reason := connectTestClient(t, url, sk).publish(signEvent(t, sk, 1, nostr.Now(), nil, "e")); !ok {
+		t.Fatal(reason)
+	}
+	other := nostr.GeneratePrivateKey()
+	if ok, reason := connectTestClient(t, url, other).publish(signEvent(t, other, 1, nostr.Now(), nil, "f")); ok || !strings.HasPrefix(reason, "rate-limited:") {
+		t.Fatalf("a second event from the IP got through: %s", reason)
+	}
+}
+
+func TestRateLimitPerPubkeyAndKind(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	noRateLimits()
+	s.RateLimitPubkey = RateLimit{Events: 2, Per: time.Hour}
+	s.RateLimitByKind = map[int]RateLimit{7: {Events: 1, Per: time.Hour}}
+
+	sk := nostr.GeneratePrivateKey()
+	if reject, msg := rateLimit(ctx, signEvent(t, sk, 7, nostr.Now(), nil, "+")); reject {
+		t.Fatal(msg)
+	}
+	if reject, msg := rateLimit(ctx, signEvent(t, sk, 7, nostr.Now(), nil, "-")); !isRateLimited(reject, msg) {
+		t.Fatalf("a second reaction got through: %s", msg)
+	}
+	if reject, msg := rateLimit(ctx, signEvent(t, sk, 1, nostr.Now(), nil, "a")); reject {
+		t.Fatalf("other kinds were limited: %s", msg)
+	}
+	if reject, msg := rateLimit(ctx, signEvent(t, sk, 1, nostr.Now(), nil, "b")); !isRateLimited(reject, msg) {
+		t.Fatalf("a third event by the author got through: %s", msg)
+	}
+
+	other := nostr.GeneratePrivateKey()
+	if reject, msg := rateLimit(ctx, signEvent(t, other, 1, nostr.Now(), nil, "a")); reject {
+		t.Fatalf("another author was limited: %s", msg)
+	}
+
+	// the relay isn't limited at all
+	for i := 0; i < 3; i++ {
+		if reject, msg := rateLimit(ctx, signEvent(t, s.RelayPrivkey, 1, nostr.Now(), nil, string(rune('a'+i)))); reject {
+			t.Fatalf("the relay was limited: %s", msg)
+		}
+	}
+}
+
+func TestRateLimitPerGroup(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	noRateLimits()
+	s.RateLimitGroup = RateLimit{Events: 2, Per: time.Hour}
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(ctx, "club", owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+	// a creator group nobody has moderated yet doesn't exist for the store
+	creatorSk := nostr.GeneratePrivateKey()
+	creator, _ := nostr.GetPublicKey(creatorSk)
+
+	for _, groupId := range []string{"club", creator} {
+		// each author only posts once, it's the group's bucket that runs out
+		for i := 0; i < 2; i++ {
+			post := signEvent(t, nostr.GeneratePrivateKey(), 9, nostr.Now(), nostr.Tags{{"h", groupId}}, "hi")
+			if reject, msg := rateLimit(ctx, post); reject {
+				t.Fatalf("%s: %s", groupId, msg)
+			}
+		}
+		post := signEvent(t, nostr.GeneratePrivateKey(), 9, nostr.Now(), nostr.Tags{{"h", groupId}}, "hi")
+		if reject, msg := rateLimit(ctx, post); !isRateLimited(reject, msg) {
+			t.Fatalf("%s: a third post got through: %s", groupId, msg)
+		}
+	}
+	if _, kept := groups.groups[creator]; kept {
+		t.Error("a group that doesn't exist was kept for its bucket")
+	}
+
+	// admins and owners go on regardless
+	for name, post := range map[string]*nostr.Event{
+		"admin":         signEvent(t, ownerSk, 9, nostr.Now(), nostr.Tags{{"h", "club"}}, "hi"),
+		"creator group": signEvent(t, creatorSk, 9, nostr.Now(), nostr.Tags{{"h", creator}}, "hi"),
+	} {
+		if reject, msg := rateLimit(ctx, post); reject {
+			t.Errorf("%s was limited: %s", name, msg)
+		}
+	}
+}
+
+func TestRateLimitTakesFromEveryBucketOrNone(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	noRateLimits()
+	s.RateLimitPubkey = RateLimit{Events: 2, Per: time.Hour}
+	s.RateLimitByKind = map[int]RateLimit{7: {Events: 1, Per: time.Hour}}
+
+	sk := nostr.GeneratePrivateKey()
+	if reject, msg := rateLimit(ctx, signEvent(t, sk, 7, nostr.Now(), nil, "+")); reject {
+		t.Fatal(msg)
+	}
+
+	// turned away by the kind's bucket, which must leave the author's alone
+	for i := 0; i < 5; i++ {
+		if reject, msg := rateLimit(ctx, signEvent(t, sk, 7, nostr.Now(), nil, string(rune('a'+i)))); !isRateLimited(reject, msg) {
+			t.Fatalf("a reaction got through: %s", msg)
+		}
+	}
+	if reject, msg := rateLimit(ctx, signEvent(t, sk, 1, nostr.Now(), nil, "a")); reject {
+		t.Fatalf("rejected events were charged to the author: %s", msg)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/fiatjaf/khatru"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+)
+
+// setupTestRelay points the globals at fresh databases in a temporary directory
+// and loads the default settings with a random relay key.
+func setupTestRelay(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("DOMAIN", "relay.test")
+	t.Setenv("RELAY_NAME", "test relay")
+	t.Setenv("RELAY_PRIVKEY", nostr.GeneratePrivateKey())
+	s = Settings{}
+	if err := envconfig.Process("", &s); err != nil {
+		t.Fatal(err)
+	}
+	s.RelayPubkey, _ = nostr.GetPublicKey(s.RelayPrivkey)
+
+	dir := t.TempDir()
+	db = &lmdb.LMDBBackend{Path: dir + "/db"}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	state = &StateStore{Path: dir + "/state"}
+	if err := state.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		state.Close()
+	})
+
+	groups = NewGroupStore()
+	limiters = make(map[string]*limiterEntry)
+	relay = khatru.NewRelay()
+	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
+}
+
+// signEvent signs an event with sk, failing the test if it can't.
+func signEvent(t *testing.T, sk string, kind int, createdAt nostr.Timestamp, tags nostr.Tags, content string) *nostr.Event {
+	t.Helper()
+
+	evt := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags, Content: content}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+// saveTestEvent saves evt straight into the database, skipping every policy.
+func saveTestEvent(t *testing.T, evt *nostr.Event) {
+	t.Helper()
+
+	if err := db.SaveEvent(context.Background(), evt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nip98Request makes a request with body authorized by sk as NIP-98 says
+func nip98Request(t *testing.T, sk string, method string, url string, body string) *http.Request {
+	t.Helper()
+
+	hash := sha256.Sum256([]byte(body))
+	tags := nostr.Tags{{"u", url}, {"method", method}}
+	if body != "" {
+		tags = append(tags, nostr.Tag{"payload", hex.EncodeToString(hash[:])})
+	}
+	auth, _ := json.Marshal(signEvent(t, sk, 27235, nostr.Now(), tags, ""))
+
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(auth))
+	return r
+}
+
+// startTestRelay serves a relay set up like main does on a local port, on top
+// of setupTestRelay, and returns its websocket url.
+func startTestRelay(t *testing.T) string {
+	t.Helper()
+
+	setupTestRelay(t)
+	relay = khatru.NewRelay()
+	setupRelay()
+
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+	relay.ServiceURL = server.URL
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// testClient talks to a relay started by startTestRelay the way clients do.
+// Everything it receives is queued in msgs by a reader goroutine.
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+	msgs chan nostr.Envelope
+}
+
+// connectTestClient connects and, unless sk is empty, authenticates as sk
+func connectTestClient(t *testing.T, url string, sk string) *testClient {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := &testClient{t: t, conn: conn, msgs: make(chan nostr.Envelope, 100)}
+	go func() {
+		defer close(client.msgs)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if env := nostr.ParseMessage(message); env != nil {
+				client.msgs <- env
+			}
+		}
+	}()
+
+	// we're asked to AUTH right away
+	auth, ok := client.next().(*nostr.AuthEnvelope)
+	if !ok || auth.Challenge == nil {
+		t.Fatal("expected an AUTH challenge")
+	}
+	if sk != "" {
+		evt := nip42.CreateUnsignedAuthEvent(*auth.Challenge, "", strings.Replace(relay.ServiceURL, "http", "ws", 1))
+		if err := evt.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		client.send(nostr.AuthEnvelope{Event: evt})
+		if ok, reason := client.waitOK(evt.ID); !ok {
+			t.Fatalf("failed to authenticate: %s", reason)
+		}
+	}
+	return client
+}
+
+func (client *testClient) send(env any) {
+	client.t.Helper()
+	if err := client.conn.WriteJSON(env); err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+// next returns the next message, or nil if none comes in a while
+func (client *testClient) next() nostr.Envelope {
+	select {
+	case env := <-client.msgs:
+		return env
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
+
+// waitOK skips everything but the OK for the given event
+func (client *testClient) waitOK(id string) (ok bool, reason string) {
+	client.t.Helper()
+	for {
+		switch env := client.next().(type) {
+		case nil:
+			client.t.Fatalf("no OK for %s", id)
+		case *nostr.OKEnvelope:
+			if env.EventID == id {
+				return env.OK, env.Reason
+			}
+		}
+	}
+}
+
+// publish sends an event and tells what the relay answered
+func (client *testClient) publish(evt *nostr.Event) (ok bool, reason string) {
+	client.t.Helper()
+	client.send(nostr.EventEnvelope{Event: *evt})
+	return client.waitOK(evt.ID)
+}
+
+// subscribe opens a subscription and returns the stored events sent before
+// EOSE. The subscription stays open, see receive.
+func (client *testClient) subscribe(id string, filter nostr.Filter) []*nostr.Event {
+	client.t.Helper()
+	client.send(nostr.ReqEnvelope{SubscriptionID: id, Filters: nostr.Filters{filter}})
+
+	var events []*nostr.Event
+	for {
+		switch env := client.next().(type) {
+		case nil:
+			client.t.Fatalf("no EOSE for %s", id)
+		case *nostr.EventEnvelope:
+			if env.SubscriptionID != nil && *env.SubscriptionID == id {
+				events = append(events, &env.Event)
+			}
+		case *nostr.EOSEEnvelope:
+			if string(*env) == id {
+				return events
+			}
+		case *nostr.ClosedEnvelope:
+			if env.SubscriptionID == id {
+				client.t.Fatalf("subscription %s closed: %s", id, env.Reason)
+			}
+		}
+	}
+}
+
+// query returns the stored events matching filter
+func (client *testClient) query(filter nostr.Filter) []*nostr.Event {
+	client.t.Helper()
+	id := "q" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	events := client.subscribe(id, filter)
+	closeEnv := nostr.CloseEnvelope(id)
+	client.send(closeEnv)
+	return events
+}
+
+// receive returns the next event sent live to the subscription, or nil if
+// none comes in a while
+func (client *testClient) receive(id string) *nostr.Event {
+	for {
+		switch env := client.next().(type) {
+		case nil:
+			return nil
+		case *nostr.EventEnvelope:
+			if env.SubscriptionID != nil && *env.SubscriptionID == id {
+				return &env.Event
+			}
+		}
+	}
+}
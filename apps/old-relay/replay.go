@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// the lmdb backend caps every query at its MaxLimit (500 by default), so we
+// can't just ask for everything at once
+const defaultReplayPageSize = 500
+
+// ReplayFailure is a stored moderation event that couldn't be turned into an
+// Action, so it was skipped during replay.
+type ReplayFailure struct {
+	Event *nostr.Event
+	Err   error
+}
+
+// Replayer rebuilds group state from the moderation history kept in Store.
+type Replayer struct {
+	Store    eventstore.Store
+	PageSize int
+}
+
+// History fetches every moderation event tagged with the given group created at
+// or after since, paging backwards through the store, and returns them oldest
+// first. Events with the same created_at are ordered by id so the replay is
+// deterministic.
+func (r Replayer) History(ctx context.Context, groupId string, since nostr.Timestamp) ([]*nostr.Event, error) {
+	pageSize := r.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultReplayPageSize
+	}
+
+	filter := nostr.Filter{
+		Kinds: maps.Keys(moderationActionFactories),
+		Tags:  nostr.TagMap{"h": []string{groupId}},
+	}
+	if since > 0 {
+		filter.Since = &since
+	}
+
+	var events []*nostr.Event
+	if err := pageEvents(ctx, r.Store, filter, pageSize, func(page []*nostr.Event) error {
+		events = append(events, page...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].CreatedAt != events[j].CreatedAt {
+			return events[i].CreatedAt < events[j].CreatedAt
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	return events, nil
+}
+
+// pageEvents goes through every event matching filter, newest first, handing
+// them over a page at a time. A page may stop in the middle of its oldest
+// second, so all of that second is fetched with secondEvents before moving past
+// it, and no event is handed over twice.
+func pageEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, pageSize int, handle func([]*nostr.Event) error) error {
+	filter.Limit = pageSize
+	for {
+		page, err := queryAll(ctx, store, filter)
+		if err != nil {
+			return err
+		}
+		if len(page) < pageSize {
+			return handle(page)
+		}
+
+		oldest := page[0].CreatedAt
+		for _, event := range page {
+			if event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+		}
+		boundary, err := secondEvents(ctx, store, filter, oldest, pageSize)
+		if err != nil {
+			return err
+		}
+		whole := make([]*nostr.Event, 0, len(page)+len(boundary))
+		for _, event := range page {
+			if event.CreatedAt != oldest {
+				whole = append(whole, event)
+			}
+		}
+		if err := handle(append(whole, boundary...)); err != nil {
+			return err
+		}
+
+		if oldest == 0 || (filter.Since != nil && oldest <= *filter.Since) {
+			return nil
+		}
+		next := oldest - 1
+		filter.Until = &next
+	}
+}
+
+// secondEvents returns every event matching filter that was created at the
+// given second. The store caps every query, so when the whole second doesn't
+// fit in a page it is asked for one kind at a time. Without kinds in the filter
+// only the kinds in the capped result are known, so the store must be able to
+// count the second to tell none were missed. A single kind filling a page
+// within one second can't be split any further and is reported as an error
+// instead of being cut short.
+func secondEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, second nostr.Timestamp, pageSize int) ([]*nostr.Event, error) {
+	filter.Since = &second
+	filter.Until = &second
+	filter.Limit = pageSize
+
+	events, err := queryAll(ctx, store, filter)
+	if err != nil || len(events) < pageSize {
+		return events, err
+	}
+
+	kinds := filter.Kinds
+	expected := int64(-1)
+	if len(kinds) == 0 {
+		counter, ok := store.(eventCounter)
+		if !ok {
+			return nil, fmt.Errorf("%d or more events at %d, can't page through them", pageSize, second)
+		}
+		if expected, err = counter.CountEvents(ctx, filter); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if !slices.Contains(kinds, event.Kind) {
+				kinds = append(kinds, event.Kind)
+			}
+		}
+	}
+	if len(kinds) <= 1 {
+		return nil, fmt.Errorf("%d or more events of one kind at %d, can't page through them", pageSize, second)
+	}
+
+	events = nil
+	for _, kind := range kinds {
+		filter.Kinds = []int{kind}
+		ofKind, err := secondEvents(ctx, store, filter, second, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ofKind...)
+	}
+	if expected >= 0 && int64(len(events)) < expected {
+		return nil, fmt.Errorf("%d events at %d, but only %d of them could be paged through", expected, second, len(events))
+	}
+	return events, nil
+}
+
+// eventCounter is implemented by stores that can count without querying, like
+// the lmdb backend.
+type eventCounter interface {
+	CountEvents(ctx context.Context, filter nostr.Filter) (int64, error)
+}
+
+func queryAll(ctx context.Context, store eventstore.Store, filter nostr.Filter) ([]*nostr.Event, error) {
+	ch, err := store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for event := range ch {
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Replay applies the given events, in order, to the group. Events that don't
+// parse as a known moderation action are skipped and reported back.
+func (r Replayer) Replay(group *Group, events []*nostr.Event) []ReplayFailure {
+	var failures []ReplayFailure
+
+	for _, event := range events {
+		group.advanceCheckpoint(event)
+
+		makeModerationAction, ok := moderationActionFactories[event.Kind]
+		if !ok {
+			failures = append(failures, ReplayFailure{event, errUnknownModerationAction})
+			continue
+		}
+		action, err := makeModerationAction(event)
+		if err != nil {
+			failures = append(failures, ReplayFailure{event, err})
+			continue
+		}
+		action.Apply(group)
+	}
+
+	return failures
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// the people in testdata/moderation_log.jsonl, a recorded history of a creator
+// group with several events sharing the same second
+const (
+	fixtureGroup = "abeda540c787b5b8f1b0d12d410ffe1fce270d463717e41c29c49d8701158fc1"
+	fixtureAlice = "6d6eda430d100d0ba27c777014eae53e51829f86b803ada919404cdc7497e621"
+	fixtureBob   = "3a5f8b521a24abc1ea831871e96ee6137f5a841a3397afbc0cc0098206ff3e90"
+	fixtureCarol = "974dd11cf9b1c7943e4f4785d0d66708fb8b90de718883ce05192288c1d89818"
+	fixtureDave  = "cd1356f0d358cb804c0c6d9d069f85a14081e90cb2e1071befe5281f45653cf7"
+)
+
+func loadFixtureLog(t *testing.T, path string) []*nostr.Event {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var events []*nostr.Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := event.CheckSignature(); err != nil || !ok {
+			t.Fatalf("fixture event %s has an invalid signature", event.ID)
+		}
+		events = append(events, &event)
+		saveTestEvent(t, &event)
+	}
+	return events
+}
+
+func TestReplayFixtureLog(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	logged := loadFixtureLog(t, "testdata/moderation_log.jsonl")
+
+	for _, pageSize := range []int{5, 7, 0} {
+		replayer := Replayer{Store: db, PageSize: pageSize}
+		history, err := replayer.History(ctx, fixtureGroup, 0)
+		if err != nil {
+			t.Fatalf("page size %d: %s", pageSize, err)
+		}
+
+		// everything but the chat message, oldest first with ties broken by id
+		if len(history) != len(logged)-1 {
+			t.Fatalf("page size %d: got %d events, expected %d", pageSize, len(history), len(logged)-1)
+		}
+		if !sort.SliceIsSorted(history, func(i, j int) bool {
+			if history[i].CreatedAt != history[j].CreatedAt {
+				return history[i].CreatedAt < history[j].CreatedAt
+			}
+			return history[i].ID < history[j].ID
+		}) {
+			t.Fatalf("page size %d: history out of order", pageSize)
+		}
+
+		group := newGroup(fixtureGroup)
+		failures := replayer.Replay(group, history)
+		if len(failures) != 1 || failures[0].Event.Content != "no targets" {
+			t.Fatalf("page size %d: expected only the event without targets to fail, got %v", pageSize, failures)
+		}
+
+		if group.Name != "fixture group" || group.About != "a recorded history" {
+			t.Errorf("page size %d: wrong metadata %q %q", pageSize, group.Name, group.About)
+		}
+		if group.Private || !group.Closed {
+			t.Errorf("page size %d: expected a public closed group", pageSize)
+		}
+		if role := group.Members[fixtureAlice]; role != emptyRole {
+			t.Errorf("page size %d: alice should be a plain member again, got %v", pageSize, role)
+		}
+		if role := group.Members[fixtureBob]; role == nil || role != group.Roles["moderator"] {
+			t.Errorf("page size %d: bob should hold the moderator role, got %v", pageSize, role)
+		}
+		if _, ok := group.Members[fixtureCarol]; !ok {
+			t.Errorf("page size %d: carol should be a member", pageSize)
+		}
+		if _, ok := group.Members[fixtureDave]; ok {
+			t.Errorf("page size %d: dave was removed", pageSize)
+		}
+		if group.lastEventID != history[len(history)-1].ID {
+			t.Errorf("page size %d: checkpoint not at the last event", pageSize)
+		}
+	}
+}
+
+func TestHistoryPagesThroughCrowdedSecond(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	groupId, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	stored := 0
+	for _, kind := range []int{9000, 9001, 9006} {
+		for i := 0; i < 3; i++ {
+			member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+			saveTestEvent(t, signEvent(t, s.RelayPrivkey, kind, 5000,
+				nostr.Tags{{"h", groupId}, {"p", member}, {"closed"}}, ""))
+			stored++
+		}
+	}
+	saveTestEvent(t, signEvent(t, s.RelayPrivkey, 9002, 4000, nostr.Tags{{"h", groupId}, {"name", "x"}}, ""))
+	stored++
+
+	// a whole page fits in that one second, which used to lose the rest of it
+	history, err := Replayer{Store: db, PageSize: 4}.History(ctx, groupId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != stored {
+		t.Fatalf("got %d events, expected %d", len(history), stored)
+	}
+
+	// when one kind alone fills a page there is no way to page through it, and
+	// that must be an error rather than a shorter history
+	if _, err := (Replayer{Store: db, PageSize: 3}).History(ctx, groupId, 0); err == nil {
+		t.Fatal("expected an error for a second that can't be paged through")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/maps"
+)
+
+// GroupSnapshot is the checkpointed state of a group, enough to restore it
+// without replaying the moderation history up to LastEventID.
+type GroupSnapshot struct {
+	ID      string                   `json:"id"`
+	Name    string                   `json:"name,omitempty"`
+	Picture string                   `json:"picture,omitempty"`
+	About   string                   `json:"about,omitempty"`
+	Private bool                     `json:"private,omitempty"`
+	Closed  bool                     `json:"closed,omitempty"`
+	Members map[string]*RoleSnapshot `json:"members"`
+	Roles   map[string][]Permission  `json:"roles,omitempty"`
+
+	RateLimit string `json:"rate_limit,omitempty"`
+
+	LastEventID string          `json:"last_event_id"`
+	LastEventAt nostr.Timestamp `json:"last_event_at"`
+	// events dated before the checkpoint were applied in the order they came
+	Backdated bool `json:"backdated,omitempty"`
+}
+
+// RoleSnapshot is nil for members without any admin powers. Assigned means
+// the member holds the group's role definition with the same name rather than
+// permissions of their own.
+type RoleSnapshot struct {
+	Name        string       `json:"name,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	Assigned    bool         `json:"assigned,omitempty"`
+}
+
+// checkpoint must be called with the group lock held (or on a group nobody else
+// can see yet).
+func (group *Group) checkpoint() GroupSnapshot {
+	snapshot := GroupSnapshot{
+		ID:          group.ID,
+		Name:        group.Name,
+		Picture:     group.Picture,
+		About:       group.About,
+		Private:     group.Private,
+		Closed:      group.Closed,
+		Members:     make(map[string]*RoleSnapshot, len(group.Members)),
+		Roles:       make(map[string][]Permission, len(group.Roles)),
+		RateLimit:   group.RateLimit.String(),
+		LastEventID: group.lastEventID,
+		LastEventAt: group.lastEventAt,
+		Backdated:   group.backdated,
+	}
+	for name, role := range group.Roles {
+		permissions := maps.Keys(role.Permissions)
+		sort.Strings(permissions)
+		snapshot.Roles[name] = permissions
+	}
+	for pubkey, role := range group.Members {
+		// the relay is always added back as master when restoring
+		if role == masterRole {
+			continue
+		}
+		if role == emptyRole {
+			snapshot.Members[pubkey] = nil
+			continue
+		}
+		permissions := maps.Keys(role.Permissions)
+		sort.Strings(permissions)
+		snapshot.Members[pubkey] = &RoleSnapshot{
+			Name:        role.Name,
+			Permissions: permissions,
+			Assigned:    group.isDefinedRole(role),
+		}
+	}
+	return snapshot
+}
+
+func (snapshot GroupSnapshot) restore() *Group {
+	group := newGroup(snapshot.ID)
+	group.Name = snapshot.Name
+	group.Picture = snapshot.Picture
+	group.About = snapshot.About
+	group.Private = snapshot.Private
+	group.Closed = snapshot.Closed
+	if err := group.RateLimit.Decode(snapshot.RateLimit); err != nil {
+		log.Warn().Err(err).Str("group", snapshot.ID).Msg("invalid rate limit in snapshot, using the default")
+	}
+	group.bucket = group.rateLimit().newLimiter()
+	group.lastEventID = snapshot.LastEventID
+	group.lastEventAt = snapshot.LastEventAt
+	group.backdated = snapshot.Backdated
+
+	for name, permissions := range snapshot.Roles {
+		role := &Role{Name: name, Permissions: make(map[Permission]struct{}, len(permissions))}
+		for _, perm := range permissions {
+			role.Permissions[perm] = struct{}{}
+		}
+		group.Roles[name] = role
+	}
+
+	for pubkey, rs := range snapshot.Members {
+		if rs == nil {
+			group.Members[pubkey] = emptyRole
+			continue
+		}
+		if defined, ok := group.Roles[rs.Name]; rs.Assigned && ok {
+			group.Members[pubkey] = defined
+			continue
+		}
+		role := &Role{Name: rs.Name, Permissions: make(map[Permission]struct{}, len(rs.Permissions))}
+		for _, perm := range rs.Permissions {
+			role.Permissions[perm] = struct{}{}
+		}
+		group.Members[pubkey] = role
+	}
+	return group
+}
+
+// isAfterCheckpoint tells if an event comes after the last one applied to the
+// group, using the same ordering as Replayer.History.
+func (group *Group) isAfterCheckpoint(event *nostr.Event) bool {
+	if event.CreatedAt != group.lastEventAt {
+		return event.CreatedAt > group.lastEventAt
+	}
+	return event.ID > group.lastEventID
+}
+
+// advanceCheckpoint records event as applied. The checkpoint never moves
+// backwards, so backdated events don't cause anything to be replayed twice.
+func (group *Group) advanceCheckpoint(event *nostr.Event) {
+	if group.isAfterCheckpoint(event) {
+		group.lastEventID = event.ID
+		group.lastEventAt = event.CreatedAt
+	}
+}
+
+func saveSnapshot(group *Group) {
+	if err := state.Put("snapshots", group.ID, group.checkpoint()); err != nil {
+		log.Error().Err(err).Str("group", group.ID).Msg("failed to save group snapshot")
+	}
+}
+
+func loadSnapshot(id string) *GroupSnapshot {
+	var snapshot GroupSnapshot
+	if found, err := state.Get("snapshots", id, &snapshot); err != nil {
+		log.Warn().Err(err).Str("group", id).Msg("failed to read group snapshot, replaying everything")
+		return nil
+	} else if !found {
+		return nil
+	}
+	return &snapshot
+}
+
+// snapshottedGroupIds lists every group we have a snapshot for, which is every
+// group that had a moderation action applied to it (see backfillSnapshots).
+func snapshottedGroupIds() ([]string, error) {
+	var ids []string
+	err := state.ForEach("snapshots", "", func(key string, raw []byte) error {
+		ids = append(ids, key)
+		return nil
+	})
+	return ids, err
+}
+
+// backfillSnapshots snapshots the groups that have a moderation history but no
+// snapshot, like the ones whose history predates snapshots, so listing the
+// snapshots lists them too.
+func backfillSnapshots(ctx context.Context) error {
+	missing := make(map[string]struct{})
+	filter := nostr.Filter{Kinds: maps.Keys(moderationActionFactories)}
+	if err := pageEvents(ctx, db, filter, db.MaxLimit, func(page []*nostr.Event) error {
+		for _, event := range page {
+			groupId := getGroupIdFromEvent(event, "h")
+			if _, seen := missing[groupId]; seen || groupId == "" {
+				continue
+			}
+			if found, err := state.Get("snapshots", groupId, new(json.RawMessage)); err != nil {
+				return err
+			} else if !found {
+				missing[groupId] = struct{}{}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// loading a group from its history snapshots it
+	for groupId := range missing {
+		groups.Get(ctx, groupId, false)
+	}
+	if len(missing) > 0 {
+		log.Info().Int("groups", len(missing)).Msg("snapshotted groups that had no snapshot")
+	}
+	return nil
+}
+
+// checkSnapshots rebuilds every snapshotted group from its full history and
+// compares it with what we have stored. Mismatching snapshots are logged and
+// replaced with the rebuilt state.
+//
+// Live groups apply events in the order they arrive while the rebuild goes by
+// created_at, so once a backdated event was applied the two can disagree without
+// anything being wrong. Those groups aren't checked: the order we don't store
+// can't be replayed, and the live state is what everyone has seen.
+func checkSnapshots(ctx context.Context) error {
+	var snapshots []GroupSnapshot
+	if err := state.ForEach("snapshots", "", func(key string, raw []byte) error {
+		var snapshot GroupSnapshot
+		if err := json.Unmarshal(raw, &snapshot); err != nil {
+			return fmt.Errorf("snapshot '%s': %w", key, err)
+		}
+		snapshots = append(snapshots, snapshot)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	mismatches, skipped := 0, 0
+	for _, snapshot := range snapshots {
+		if snapshot.Backdated {
+			skipped++
+			continue
+		}
+
+		rebuilt := newGroup(snapshot.ID)
+		if _, err := replayGroup(ctx, rebuilt); err != nil {
+			return err
+		}
+
+		differences := diffGroups(snapshot.restore(), rebuilt)
+		if len(differences) == 0 {
+			continue
+		}
+
+		mismatches++
+		log.Warn().Str("group", snapshot.ID).Strs("differences", differences).
+			Msg("group snapshot doesn't match its history, replacing it")
+		saveSnapshot(rebuilt)
+	}
+
+	log.Info().Int("groups", len(snapshots)).Int("mismatches", mismatches).Int("backdated", skipped).
+		Msg("checked group snapshots")
+	return nil
+}
+
+// diffGroups describes how the state of group b differs from group a.
+func diffGroups(a, b *Group) []string {
+	var differences []string
+
+	field := func(name string, va, vb any) {
+		if va != vb {
+			differences = append(differences, fmt.Sprintf("%s: %v != %v", name, va, vb))
+		}
+	}
+	field("name", a.Name, b.Name)
+	field("picture", a.Picture, b.Picture)
+	field("about", a.About, b.About)
+	field("private", a.Private, b.Private)
+	field("closed", a.Closed, b.Closed)
+	field("rate limit", a.RateLimit, b.RateLimit)
+	field("last event", a.lastEventID, b.lastEventID)
+
+	for pubkey, roleA := range a.Members {
+		roleB, ok := b.Members[pubkey]
+		if !ok {
+			differences = append(differences, "extra member "+pubkey)
+			continue
+		}
+		if describeRole(roleA) != describeRole(roleB) {
+			differences = append(differences,
+				fmt.Sprintf("role of %s: %s != %s", pubkey, describeRole(roleA), describeRole(roleB)))
+		}
+	}
+	for pubkey := range b.Members {
+		if _, ok := a.Members[pubkey]; !ok {
+			differences = append(differences, "missing member "+pubkey)
+		}
+	}
+
+	for name, roleA := range a.Roles {
+		roleB, ok := b.Roles[name]
+		if !ok {
+			differences = append(differences, "extra role "+name)
+			continue
+		}
+		if describeRole(roleA) != describeRole(roleB) {
+			differences = append(differences,
+				fmt.Sprintf("role %s: %s != %s", name, describeRole(roleA), describeRole(roleB)))
+		}
+	}
+	for name := range b.Roles {
+		if _, ok := a.Roles[name]; !ok {
+			differences = append(differences, "missing role "+name)
+		}
+	}
+
+	return differences
+}
+
+func describeRole(role *Role) string {
+	switch role {
+	case emptyRole:
+		return "member"
+	case masterRole:
+		return "master"
+	}
+	permissions := maps.Keys(role.Permissions)
+	sort.Strings(permissions)
+	return fmt.Sprintf("%s%v", role.Name, permissions)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckSnapshotsReplacesMismatches(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	groupId, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	added := signEvent(t, s.RelayPrivkey, 9000, 1000, nostr.Tags{{"h", groupId}, {"p", member}}, "")
+	saveTestEvent(t, added)
+	if err := groups.Apply(ctx, added); err != nil {
+		t.Fatal(err)
+	}
+
+	// a snapshot that lost the member
+	snapshot := loadSnapshot(groupId)
+	delete(snapshot.Members, member)
+	if err := state.Put("snapshots", groupId, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkSnapshots(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadSnapshot(groupId).Members[member]; !ok {
+		t.Fatal("the broken snapshot wasn't replaced")
+	}
+}
+
+func TestCheckSnapshotsSkipsBackdatedEvents(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	groupId, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	added := signEvent(t, s.RelayPrivkey, 9000, 2000, nostr.Tags{{"h", groupId}, {"p", member}}, "")
+	saveTestEvent(t, added)
+	if err := groups.Apply(ctx, added); err != nil {
+		t.Fatal(err)
+	}
+
+	// the removal arrives last but is dated first, so the history has it undone
+	// by the add while the live group applied it after
+	removed := signEvent(t, s.RelayPrivkey, 9001, 1000, nostr.Tags{{"h", groupId}, {"p", member}}, "")
+	saveTestEvent(t, removed)
+	if err := groups.Apply(ctx, removed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := groups.Snapshot(ctx, groupId, false).Members[member]; ok {
+		t.Fatal("the removal wasn't applied")
+	}
+
+	snapshot := loadSnapshot(groupId)
+	if !snapshot.Backdated {
+		t.Fatal("the snapshot doesn't know a backdated event was applied")
+	}
+	if err := checkSnapshots(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadSnapshot(groupId).Members[member]; ok {
+		t.Fatal("the live state was replaced by the one in created_at order")
+	}
+}
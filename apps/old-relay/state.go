@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+)
+
+// stateBuckets are the named databases opened inside the state environment
+var stateBuckets = []string{
+	"snapshots",
+	"deletions",
+	"memberships",
+	"nutzap-proofs",
+	"payment-tallies",
+	"zap-invoices",
+	"banned-pubkeys",
+	"allowed-pubkeys",
+	"banned-events",
+	"allowed-kinds",
+	"blocked-ips",
+	"relay-info",
+	"join-requests",
+	"invite-codes",
+	"visibility",
+}
+
+// StateStore is a small LMDB environment living next to the event database
+// where we keep state derived from events (so we don't have to derive it again
+// on every start) and relay-local data that isn't made of events at all.
+// Values are stored as JSON.
+type StateStore struct {
+	Path string
+
+	env     *lmdb.Env
+	buckets map[string]lmdb.DBI
+}
+
+func (st *StateStore) Init() error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+
+	env.SetMaxDBs(len(stateBuckets))
+	env.SetMaxReaders(1000)
+	env.SetMapSize(1 << 32) // ~4GB
+
+	if err := os.MkdirAll(st.Path, 0755); err != nil {
+		return err
+	}
+	if err := env.Open(st.Path, lmdb.NoTLS, 0644); err != nil {
+		return err
+	}
+	st.env = env
+
+	st.buckets = make(map[string]lmdb.DBI, len(stateBuckets))
+	return st.env.Update(func(txn *lmdb.Txn) error {
+		for _, name := range stateBuckets {
+			dbi, err := txn.OpenDBI(name, lmdb.Create)
+			if err != nil {
+				return err
+			}
+			st.buckets[name] = dbi
+		}
+		return nil
+	})
+}
+
+func (st *StateStore) Close() {
+	st.env.Close()
+}
+
+func (st *StateStore) bucket(name string) lmdb.DBI {
+	dbi, ok := st.buckets[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown state bucket '%s'", name))
+	}
+	return dbi
+}
+
+// Put stores value under key, replacing whatever was there.
+func (st *StateStore) Put(bucket string, key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return st.env.Update(func(txn *lmdb.Txn) error {
+		return txn.Put(st.bucket(bucket), []byte(key), raw, 0)
+	})
+}
+
+// Get decodes the value stored under key into value, reporting whether it was found.
+func (st *StateStore) Get(bucket string, key string, value any) (found bool, err error) {
+	err = st.env.View(func(txn *lmdb.Txn) error {
+		raw, err := txn.Get(st.bucket(bucket), []byte(key))
+		if lmdb.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		return json.Unmarshal(raw, value)
+	})
+	return found, err
+}
+
+// Delete removes key, it's not an error if it doesn't exist.
+func (st *StateStore) Delete(bucket string, key string) error {
+	return st.env.Update(func(txn *lmdb.Txn) error {
+		err := txn.Del(st.bucket(bucket), []byte(key), nil)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// ForEach calls fn with every key starting with prefix (all keys if it's empty)
+// and its raw JSON value, in key order. Returning an error from fn stops the iteration.
+func (st *StateStore) ForEach(bucket string, prefix string, fn func(key string, raw []byte) error) error {
+	return st.env.View(func(txn *lmdb.Txn) error {
+		cursor, err := txn.OpenCursor(st.bucket(bucket))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		var k, v []byte
+		if prefix == "" {
+			k, v, err = cursor.Get(nil, nil, lmdb.First)
+		} else {
+			k, v, err = cursor.Get([]byte(prefix), nil, lmdb.SetRange)
+		}
+		for ; err == nil; k, v, err = cursor.Get(nil, nil, lmdb.Next) {
+			key := string(k)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if err := fn(key, v); err != nil {
+				return err
+			}
+		}
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// NIP-88 recurring subscriptions.
+//
+// Creators describe their tiers with kind 37001 events, each with one or more
+// ["amount", <amount>, <currency>, <cadence>] tags. Subscribers publish a kind
+// 7001 pointing at the tier with an "a" tag, the creator with a "p" tag and the
+// option they picked with an "amount" tag. Payments are credited to a 7001 by
+// receipts referencing it with an "e" tag: kind 7003 receipts signed by the
+// creator (or by us), and NIP-61 nutzaps (see nutzaps.go).
+//
+// The membership tier name is the tier's "d" tag, which is what gated content
+// references in its "f" tags.
+
+// TierAmount is one of the prices a tier can be paid with
+type TierAmount struct {
+	Amount   int64
+	Currency string
+	Cadence  string
+}
+
+type Tier struct {
+	Creator string
+	ID      string
+	Amounts []TierAmount
+}
+
+// Subscription is a parsed kind 7001
+type Subscription struct {
+	ID         string
+	Subscriber string
+	Creator    string
+	TierID     string
+	GroupID    string
+	Amount     TierAmount
+	CreatedAt  nostr.Timestamp
+}
+
+var validCadences = map[string]struct{}{
+	"daily":     {},
+	"weekly":    {},
+	"monthly":   {},
+	"quarterly": {},
+	"yearly":    {},
+}
+
+func parseAmountTag(tag nostr.Tag) (TierAmount, error) {
+	if len(tag) < 4 {
+		return TierAmount{}, fmt.Errorf("amount tag must have amount, currency and cadence")
+	}
+	amount, err := strconv.ParseInt(tag[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return TierAmount{}, fmt.Errorf("invalid amount '%s'", tag[1])
+	}
+	if _, ok := validCadences[tag[3]]; !ok {
+		return TierAmount{}, fmt.Errorf("invalid cadence '%s'", tag[3])
+	}
+	return TierAmount{Amount: amount, Currency: strings.ToLower(tag[2]), Cadence: tag[3]}, nil
+}
+
+func parseTier(evt *nostr.Event) (*Tier, error) {
+	if evt.Kind != 37001 {
+		return nil, fmt.Errorf("not a tier")
+	}
+	dTag := evt.Tags.GetFirst([]string{"d", ""})
+	if dTag == nil {
+		return nil, fmt.Errorf("tier without 'd' tag")
+	}
+
+	tier := &Tier{Creator: evt.PubKey, ID: (*dTag)[1]}
+	for _, tag := range evt.Tags.GetAll([]string{"amount", ""}) {
+		amount, err := parseAmountTag(tag)
+		if err != nil {
+			continue
+		}
+		tier.Amounts = append(tier.Amounts, amount)
+	}
+	return tier, nil
+}
+
+func parseSubscription(evt *nostr.Event) (*Subscription, error) {
+	if evt.Kind != 7001 {
+		return nil, fmt.Errorf("not a subscription")
+	}
+
+	aTag := evt.Tags.GetFirst([]string{"a", "37001:"})
+	if aTag == nil {
+		return nil, fmt.Errorf("missing tier ('a') tag")
+	}
+	parts := strings.SplitN((*aTag)[1], ":", 3)
+	if len(parts) != 3 || !nostr.IsValidPublicKeyHex(parts[1]) {
+		return nil, fmt.Errorf("invalid tier address '%s'", (*aTag)[1])
+	}
+
+	amountTag := evt.Tags.GetFirst([]string{"amount", ""})
+	if amountTag == nil {
+		return nil, fmt.Errorf("missing 'amount' tag")
+	}
+	amount, err := parseAmountTag(*amountTag)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{
+		ID:         evt.ID,
+		Subscriber: evt.PubKey,
+		Creator:    parts[1],
+		TierID:     parts[2],
+		Amount:     amount,
+		CreatedAt:  evt.CreatedAt,
+	}
+
+	if pTag := evt.Tags.GetFirst([]string{"p", ""}); pTag != nil && (*pTag)[1] != sub.Creator {
+		return nil, fmt.Errorf("'p' tag doesn't match the tier creator")
+	}
+
+	// creator groups are identified by the creator pubkey
+	sub.GroupID = sub.Creator
+	if groupId := getGroupIdFromEvent(evt, "h"); groupId != "" {
+		sub.GroupID = groupId
+	}
+
+	return sub, nil
+}
+
+func loadTier(ctx context.Context, creator string, id string) (*Tier, error) {
+	vrelay := eventstore.RelayWrapper{Store: db}
+	res, err := vrelay.QuerySync(ctx, nostr.Filter{
+		Kinds: []int{37001}, Authors: []string{creator}, Tags: nostr.TagMap{"d": []string{id}}, Limit: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("unknown tier '%s'", id)
+	}
+	return parseTier(res[0])
+}
+
+// canSellMemberships tells if creator may be paid for memberships to a group:
+// their own creator group, or one where they can add members.
+func canSellMemberships(ctx context.Context, creator string, groupId string) error {
+	if groupId == creator {
+		return nil
+	}
+
+	group := groups.Snapshot(ctx, groupId, false)
+	if group == nil {
+		return fmt.Errorf("unknown group '%s'", groupId)
+	}
+	if !group.can(creator, PermAddUser) {
+		return fmt.Errorf("tier creator isn't an admin of group '%s' who can add members", groupId)
+	}
+	return nil
+}
+
+// verifySubscription checks a subscription against the creator's tier: the
+// amount chosen must be one of the tier's prices, and the creator must be able
+// to sell memberships to the group the subscription is for.
+func verifySubscription(ctx context.Context, sub *Subscription) (*Tier, error) {
+	if err := canSellMemberships(ctx, sub.Creator, sub.GroupID); err != nil {
+		return nil, err
+	}
+
+	tier, err := loadTier(ctx, sub.Creator, sub.TierID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, amount := range tier.Amounts {
+		if amount == sub.Amount {
+			return tier, nil
+		}
+	}
+	return nil, fmt.Errorf("%d %s %s is not a price of tier '%s'",
+		sub.Amount.Amount, sub.Amount.Currency, sub.Amount.Cadence, tier.ID)
+}
+
+func loadSubscription(ctx context.Context, id string) (*Subscription, error) {
+	vrelay := eventstore.RelayWrapper{Store: db}
+	res, err := vrelay.QuerySync(ctx, nostr.Filter{IDs: []string{id}, Kinds: []int{7001}})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("unknown subscription '%s'", id)
+	}
+	return parseSubscription(res[0])
+}
+
+// Payment is money received for a subscription, whatever the source.
+type Payment struct {
+	Subscription string
+	Receipt      string
+	Amount       TierAmount
+	Source       string
+}
+
+// findSubscription returns the subscription of subscriber to creator among the
+// referenced events, or else the subscriber's latest one to creator.
+func findSubscription(ctx context.Context, subscriber string, creator string, refs []string) (*Subscription, error) {
+	for _, ref := range refs {
+		if sub, err := loadSubscription(ctx, ref); err == nil && sub.Subscriber == subscriber && sub.Creator == creator {
+			return sub, nil
+		}
+	}
+
+	vrelay := eventstore.RelayWrapper{Store: db}
+	res, err := vrelay.QuerySync(ctx, nostr.Filter{
+		Kinds: []int{7001}, Authors: []string{subscriber}, Tags: nostr.TagMap{"p": []string{creator}}, Limit: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no subscription to %s", creator)
+	}
+	return parseSubscription(res[0])
+}
+
+// creditPayment grants the membership paid for. The amount must cover the price
+// the subscriber picked.
+func creditPayment(ctx context.Context, payment Payment) error {
+	sub, err := loadSubscription(ctx, payment.Subscription)
+	if err != nil {
+		return err
+	}
+	if _, err := verifySubscription(ctx, sub); err != nil {
+		return err
+	}
+
+	if payment.Amount.Currency != sub.Amount.Currency || payment.Amount.Amount < sub.Amount.Amount {
+		return fmt.Errorf("payment of %d %s doesn't cover %d %s",
+			payment.Amount.Amount, payment.Amount.Currency, sub.Amount.Amount, sub.Amount.Currency)
+	}
+	if payment.Amount.Cadence != "" && payment.Amount.Cadence != sub.Amount.Cadence {
+		return fmt.Errorf("payment is for a %s cadence, subscription is %s", payment.Amount.Cadence, sub.Amount.Cadence)
+	}
+
+	log.Info().Str("group", sub.GroupID).Str("subscriber", sub.Subscriber).Str("tier", sub.TierID).
+		Str("source", payment.Source).Str("receipt", payment.Receipt).Msg("credited subscription payment")
+
+	return grantMembership(ctx, sub, payment)
+}
+
+// validateSubscriptions rejects 7001s that don't match their tier and 7003
+// receipts issued by anyone other than the creator or us.
+func validateSubscriptions(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	switch event.Kind {
+	case 7001:
+		sub, err := parseSubscription(event)
+		if err != nil {
+			return true, "invalid: " + err.Error()
+		}
+		if _, err := verifySubscription(ctx, sub); err != nil {
+			return true, "invalid: " + err.Error()
+		}
+	case 7003:
+		eTag := event.Tags.GetFirst([]string{"e", ""})
+		if eTag == nil {
+			return true, "invalid: receipt must reference a subscription"
+		}
+		sub, err := loadSubscription(ctx, (*eTag)[1])
+		if err != nil {
+			return true, "invalid: " + err.Error()
+		}
+		if event.PubKey != sub.Creator && event.PubKey != s.RelayPubkey {
+			return true, "restricted: only the creator can issue receipts"
+		}
+	}
+
+	return false, ""
+}
+
+// ingestPaymentReceipt credits kind 7003 receipts, which have already been
+// validated by validateSubscriptions.
+func ingestPaymentReceipt(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 7003 {
+		return
+	}
+
+	payment := Payment{Receipt: event.ID, Source: "receipt"}
+	if eTag := event.Tags.GetFirst([]string{"e", ""}); eTag != nil {
+		payment.Subscription = (*eTag)[1]
+	}
+	amountTag := event.Tags.GetFirst([]string{"amount", ""})
+	if amountTag == nil {
+		log.Warn().Str("receipt", event.ID).Msg("receipt without amount")
+		return
+	}
+	// the cadence is optional in receipts
+	amount, err := strconv.ParseInt((*amountTag)[1], 10, 64)
+	if err != nil || len(*amountTag) < 3 {
+		log.Warn().Str("receipt", event.ID).Msg("receipt with invalid amount")
+		return
+	}
+	payment.Amount = TierAmount{Amount: amount, Currency: strings.ToLower((*amountTag)[2])}
+	if len(*amountTag) >= 4 {
+		payment.Amount.Cadence = (*amountTag)[3]
+	}
+
+	if err := creditPayment(ctx, payment); err != nil {
+		log.Warn().Err(err).Str("receipt", event.ID).Msg("failed to credit payment receipt")
+	}
+}
+
+// PaymentTally is what a subscription received during one of its periods from
+// sources that pay in sats, a little at a time, like nutzaps and zaps.
+type PaymentTally struct {
+	Subscription string   `json:"subscription"`
+	Period       int64    `json:"period"`
+	Sats         int64    `json:"sats"`
+	Receipts     []string `json:"receipts"`
+	Credited     bool     `json:"credited"`
+}
+
+// serializes updates to tallies
+var talliesMutex sync.Mutex
+
+// satsIn converts sats to the currency a subscription is priced in
+func satsIn(sats int64, currency string) (int64, bool) {
+	switch currency {
+	case "sat", "sats":
+		return sats, true
+	case "msat", "msats":
+		return sats * 1000, true
+	default:
+		return 0, false
+	}
+}
+
+// tallyPayment adds sats to the tally of the current period of a subscription,
+// periods being counted from the subscription by its cadence. It returns the
+// payment to credit when this one made the tally cover the price.
+func tallyPayment(sub *Subscription, receipt string, sats int64, source string) (*Payment, error) {
+	talliesMutex.Lock()
+	defer talliesMutex.Unlock()
+
+	period := int64(0)
+	if elapsed := nostr.Now() - sub.CreatedAt; elapsed > 0 {
+		period = int64(elapsed) / int64(cadenceDurations[sub.Amount.Cadence].Seconds())
+	}
+
+	var tally PaymentTally
+	key := fmt.Sprintf("%s:%d", sub.ID, period)
+	if _, err := state.Get("payment-tallies", key, &tally); err != nil {
+		return nil, err
+	}
+	if slices.Contains(tally.Receipts, receipt) {
+		return nil, nil
+	}
+	tally.Subscription = sub.ID
+	tally.Period = period
+	tally.Sats += sats
+	tally.Receipts = append(tally.Receipts, receipt)
+
+	var payment *Payment
+	if amount, ok := satsIn(tally.Sats, sub.Amount.Currency); !ok {
+		log.Warn().Str("subscription", sub.ID).Str("currency", sub.Amount.Currency).
+			Str("source", source).Msg("can't credit sats to a subscription not priced in sats")
+	} else if !tally.Credited && amount >= sub.Amount.Amount {
+		tally.Credited = true
+		payment = &Payment{
+			Subscription: sub.ID,
+			Receipt:      receipt,
+			Amount:       TierAmount{Amount: amount, Currency: sub.Amount.Currency},
+			Source:       source,
+		}
+	}
+
+	if err := state.Put("payment-tallies", key, tally); err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSubscriptionsOnlyForGroupsTheCreatorRuns(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	const groupId = "victim"
+	if err := createGroup(ctx, groupId, owner, GroupSetup{Name: "victim"}); err != nil {
+		t.Fatal(err)
+	}
+
+	attackerSk := nostr.GeneratePrivateKey()
+	attacker, _ := nostr.GetPublicKey(attackerSk)
+
+	tier := func(sk string) {
+		saveTestEvent(t, signEvent(t, sk, 37001, nostr.Now(),
+			nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}}, ""))
+	}
+	subscribe := func(sk string, creator string, tags ...nostr.Tag) *nostr.Event {
+		return signEvent(t, sk, 7001, nostr.Now(), append(nostr.Tags{
+			{"a", "37001:" + creator + ":gold"},
+			{"p", creator},
+			{"amount", "21", "sat", "monthly"},
+		}, tags...), "")
+	}
+	tier(ownerSk)
+	tier(attackerSk)
+
+	// the attacker subscribes to their own tier, naming someone else's group
+	hijack := subscribe(attackerSk, attacker, nostr.Tag{"h", groupId})
+	if reject, msg := validateSubscriptions(ctx, hijack); !reject {
+		t.Fatal("subscription to a group the creator doesn't run was accepted")
+	} else if !strings.Contains(msg, "admin") {
+		t.Errorf("unexpected rejection: %s", msg)
+	}
+
+	// nor can a receipt for it, stored anyway, grant a membership
+	saveTestEvent(t, hijack)
+	err := creditPayment(ctx, Payment{
+		Subscription: hijack.ID,
+		Receipt:      "receipt",
+		Amount:       TierAmount{Amount: 21, Currency: "sat"},
+		Source:       "receipt",
+	})
+	if err == nil {
+		t.Fatal("payment for a hijacked group was credited")
+	}
+	if group := groups.Snapshot(ctx, groupId, false); group == nil {
+		t.Fatal("group is gone")
+	} else if _, isMember := group.Members[attacker]; isMember {
+		t.Fatal("attacker became a member")
+	}
+
+	subscriberSk := nostr.GeneratePrivateKey()
+	for name, sub := range map[string]*nostr.Event{
+		"owner's group":   subscribe(subscriberSk, owner, nostr.Tag{"h", groupId}),
+		"creator group":   subscribe(subscriberSk, attacker),
+		"own creator tag": subscribe(subscriberSk, attacker, nostr.Tag{"h", attacker}),
+	} {
+		if reject, msg := validateSubscriptions(ctx, sub); reject {
+			t.Errorf("%s: legit subscription rejected: %s", name, msg)
+		}
+	}
+}
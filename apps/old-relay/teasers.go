@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// teaserTags are copied as they are from the gated event to its teaser
+var teaserTags = []string{"title", "summary", "image", "thumb", "published_at", "t"}
+
+// makeTeaser synthesizes a relay-signed preview of a gated long-form event for
+// readers who aren't entitled to it: same kind, with the title, summary, image
+// and the first paragraphs of the content, plus a "tier" tag for each tier that
+// gives access to the full version, which is referenced by its "a" and "e" tags.
+//
+// The teaser carries the original created_at so it has a stable id, and its "d"
+// tag is the full version's address so teasers of different authors never clash.
+func makeTeaser(event *nostr.Event) (*nostr.Event, error) {
+	if isSealed(event) {
+		// we only ever work on our own copy of the event here
+		if err := unsealContent(event); err != nil {
+			return nil, err
+		}
+	}
+
+	address := fmt.Sprintf("%d:%s:", event.Kind, event.PubKey)
+	if dTag := event.Tags.GetFirst([]string{"d", ""}); dTag != nil {
+		address += (*dTag)[1]
+	}
+
+	teaser := &nostr.Event{
+		Kind:      event.Kind,
+		CreatedAt: event.CreatedAt,
+		Content:   firstParagraphs(event.Content, s.TeaserParagraphs),
+		Tags: nostr.Tags{
+			nostr.Tag{"d", address},
+			nostr.Tag{"a", address},
+			nostr.Tag{"e", event.ID},
+			nostr.Tag{"p", event.PubKey},
+			nostr.Tag{"teaser"},
+		},
+	}
+	if groupId := getGroupIdFromEvent(event, "h"); groupId != "" {
+		teaser.Tags = append(teaser.Tags, nostr.Tag{"h", groupId})
+	}
+	for _, name := range teaserTags {
+		for _, tag := range event.Tags.GetAll([]string{name, ""}) {
+			teaser.Tags = append(teaser.Tags, tag)
+		}
+	}
+	for _, tier := range getTiersFromEvent(event) {
+		teaser.Tags = append(teaser.Tags, nostr.Tag{"tier", tier})
+	}
+
+	if err := teaser.Sign(s.RelayPrivkey); err != nil {
+		return nil, err
+	}
+	return teaser, nil
+}
+
+// firstParagraphs returns the first n blank-line separated paragraphs of a
+// markdown text.
+func firstParagraphs(text string, n int) string {
+	paragraphs := make([]string, 0, n)
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if len(paragraphs) >= n {
+			break
+		}
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+		}
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
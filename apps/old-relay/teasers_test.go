@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+func TestFirstParagraphs(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		text     string
+		n        int
+		expected string
+	}{
+		{"more than enough", "one\n\ntwo\n\nthree\n\nfour", 3, "one\n\ntwo\n\nthree"},
+		{"fewer than asked for", "one\n\ntwo", 3, "one\n\ntwo"},
+		{"crlf", "one\r\n\r\ntwo\r\n\r\nthree", 2, "one\n\ntwo"},
+		{"leading blank lines", "\n\n\n\none\n\ntwo", 1, "one"},
+		{"extra blank lines between", "one\n\n\n\n\ntwo\n\nthree", 2, "one\n\ntwo"},
+		{"lines in a paragraph", "one\nstill one\n\ntwo", 1, "one\nstill one"},
+		{"empty", "", 3, ""},
+		{"none asked for", "one\n\ntwo", 0, ""},
+	} {
+		if got := firstParagraphs(v.text, v.n); got != v.expected {
+			t.Errorf("%s: got %q, expected %q", v.name, got, v.expected)
+		}
+	}
+}
+
+func TestMakeTeaser(t *testing.T) {
+	setupTestRelay(t)
+	s.TeaserParagraphs = 1
+
+	sk := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(sk)
+	article := signEvent(t, sk, 30023, 1700000000, nostr.Tags{
+		{"d", "my-article"},
+		{"h", "group"},
+		{"title", "Title"},
+		{"summary", "Summary"},
+		{"t", "one"},
+		{"t", "two"},
+		{"f", "gold"},
+		{"f", "silver"},
+		{"client", "not copied"},
+	}, "first\r\n\r\nsecond")
+
+	teaser, err := makeTeaser(article)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := teaser.CheckSignature(); !ok || teaser.PubKey != s.RelayPubkey {
+		t.Error("teaser isn't signed by the relay")
+	}
+	if teaser.Kind != article.Kind || teaser.CreatedAt != article.CreatedAt {
+		t.Errorf("teaser has kind %d and created_at %d", teaser.Kind, teaser.CreatedAt)
+	}
+	if teaser.Content != "first" {
+		t.Errorf("teaser content is %q", teaser.Content)
+	}
+
+	address := "30023:" + author + ":my-article"
+	expected := nostr.Tags{
+		{"d", address},
+		{"a", address},
+		{"e", article.ID},
+		{"p", author},
+		{"teaser"},
+		{"h", "group"},
+		{"title", "Title"},
+		{"summary", "Summary"},
+		{"t", "one"},
+		{"t", "two"},
+		{"tier", "gold"},
+		{"tier", "silver"},
+	}
+	if !slices.EqualFunc(teaser.Tags, expected, func(a, b nostr.Tag) bool { return slices.Equal(a, b) }) {
+		t.Errorf("teaser tags are %v, expected %v", teaser.Tags, expected)
+	}
+
+	// articles without a d tag or a group still get a full address and no h
+	bare := signEvent(t, sk, 30023, 1700000000, nostr.Tags{{"f", "gold"}}, "text")
+	teaser, err = makeTeaser(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := teaser.Tags.GetFirst([]string{"d", ""}); d == nil || (*d)[1] != "30023:"+author+":" {
+		t.Errorf("teaser d tag is %v", d)
+	}
+	if teaser.Tags.GetFirst([]string{"h", ""}) != nil {
+		t.Error("teaser of an article outside a group has an h tag")
+	}
+}
+
+func TestTeasersAnswerQueriesForTheFullVersion(t *testing.T) {
+	url := startTestRelay(t)
+
+	ownerSk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(ownerSk)
+	if err := createGroup(context.Background(), owner, owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+	article := signEvent(t, ownerSk, 30023, nostr.Now(), nostr.Tags{{"d", "article"}, {"h", owner}, {"f", "gold"}}, "secret")
+	if ok, reason := connectTestClient(t, url, ownerSk).publish(article); !ok {
+		t.Fatal(reason)
+	}
+
+	reader := connectTestClient(t, url, nostr.GeneratePrivateKey())
+	for name, filter := range map[string]nostr.Filter{
+		"by group":   {Kinds: []int{30023}, Tags: nostr.TagMap{"h": []string{owner}}},
+		"by author":  {Kinds: []int{30023}, Authors: []string{owner}},
+		"by id":      {IDs: []string{article.ID}},
+		"by address": {Kinds: []int{30023}, Authors: []string{owner}, Tags: nostr.TagMap{"d": []string{"article"}}},
+	} {
+		got := reader.query(filter)
+		if len(got) != 1 || got[0].PubKey != s.RelayPubkey || got[0].Tags.GetFirst([]string{"teaser"}) == nil {
+			t.Errorf("%s: expected the teaser, got %v", name, got)
+		}
+	}
+}
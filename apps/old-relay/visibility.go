@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Whether an anonymous reader is asked to AUTH is decided from an index of how
+// many public and gated events each group has of each kind, instead of running
+// their filters once more just to look at the results. Events are counted when
+// they are saved and uncounted when they are deleted through deleteEvent.
+
+type KindVisibility struct {
+	Public int `json:"public"`
+	Gated  int `json:"gated"`
+}
+
+// serializes updates to the visibility index
+var visibilityMutex sync.Mutex
+
+// visibilityPrefix starts the keys of a group with the length of its id, so no
+// group's prefix is the start of another's. Events outside groups are indexed
+// under the empty group id.
+func visibilityPrefix(groupId string) string {
+	return strconv.Itoa(len(groupId)) + ":" + groupId + ":"
+}
+
+func visibilityKey(groupId string, kind int) string {
+	return visibilityPrefix(groupId) + strconv.Itoa(kind)
+}
+
+func indexVisibility(ctx context.Context, event *nostr.Event) {
+	visibilityMutex.Lock()
+	defer visibilityMutex.Unlock()
+
+	if err := countVisibility(event, 1); err != nil {
+		log.Error().Err(err).Str("event", event.ID).Msg("failed to index event visibility")
+	}
+}
+
+// deleteEvent removes an event from the database and from the visibility index.
+// Everything that deletes events goes through here.
+func deleteEvent(ctx context.Context, event *nostr.Event) error {
+	if err := db.DeleteEvent(ctx, event); err != nil {
+		return err
+	}
+
+	visibilityMutex.Lock()
+	defer visibilityMutex.Unlock()
+
+	if err := countVisibility(event, -1); err != nil {
+		log.Error().Err(err).Str("event", event.ID).Msg("failed to unindex event visibility")
+	}
+	return nil
+}
+
+// countVisibility adds delta to the count of the event's group, kind and
+// visibility. It must be called with visibilityMutex held.
+func countVisibility(event *nostr.Event, delta int) error {
+	key := visibilityKey(getGroupIdFromEvent(event, "h"), event.Kind)
+
+	var visibility KindVisibility
+	if _, err := state.Get("visibility", key, &visibility); err != nil {
+		return err
+	}
+	count := &visibility.Public
+	if isGated(event) {
+		count = &visibility.Gated
+	}
+	if *count += delta; *count < 0 {
+		*count = 0
+	}
+
+	if visibility.Public == 0 && visibility.Gated == 0 {
+		return state.Delete("visibility", key)
+	}
+	return state.Put("visibility", key, visibility)
+}
+
+// onlyGatedEvents tells if everything the filter can match, as far as its kinds
+// and groups go, is gated.
+func onlyGatedEvents(filter nostr.Filter) (bool, error) {
+	prefixes := []string{""}
+	if groupIds := filter.Tags["h"]; len(groupIds) > 0 {
+		prefixes = make([]string, len(groupIds))
+		for i, groupId := range groupIds {
+			prefixes[i] = visibilityPrefix(groupId)
+		}
+	}
+
+	var total KindVisibility
+	for _, prefix := range prefixes {
+		if err := state.ForEach("visibility", prefix, func(key string, raw []byte) error {
+			if len(filter.Kinds) > 0 {
+				kind, err := strconv.Atoi(key[strings.LastIndexByte(key, ':')+1:])
+				if err != nil || !slices.Contains(filter.Kinds, kind) {
+					return nil
+				}
+			}
+
+			var visibility KindVisibility
+			if err := json.Unmarshal(raw, &visibility); err != nil {
+				return fmt.Errorf("visibility '%s': %w", key, err)
+			}
+			total.Public += visibility.Public
+			total.Gated += visibility.Gated
+			return nil
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	return total.Gated > 0 && total.Public == 0, nil
+}
+
+// buildVisibilityIndex counts every stored event, if the index is still empty.
+// It only does real work on the first start after the index was introduced.
+func buildVisibilityIndex(ctx context.Context) error {
+	visibilityMutex.Lock()
+	defer visibilityMutex.Unlock()
+
+	if built, err := hasEntries("visibility"); err != nil || built {
+		return err
+	}
+
+	indexed := 0
+	if err := pageEvents(ctx, db, nostr.Filter{}, db.MaxLimit, func(page []*nostr.Event) error {
+		for _, event := range page {
+			if err := countVisibility(event, 1); err != nil {
+				return err
+			}
+		}
+		indexed += len(page)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.Info().Int("events", indexed).Msg("built visibility index")
+	return nil
+}
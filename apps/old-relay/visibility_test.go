@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestVisibilityKeysDontMixUpGroups(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	indexVisibility(ctx, signEvent(t, sk, 1, 1000, nostr.Tags{{"h", "a"}, {"f", "gold"}}, "gated"))
+	indexVisibility(ctx, signEvent(t, sk, 1, 1000, nostr.Tags{{"h", "a:b"}}, "public"))
+
+	onlyGated, err := onlyGatedEvents(nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"h": []string{"a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !onlyGated {
+		t.Fatal("the public events of 'a:b' were counted for 'a'")
+	}
+}
+
+func TestDeletedEventsAreUncounted(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	gated := signEvent(t, sk, 1, 1000, nostr.Tags{{"h", "group"}, {"f", "gold"}}, "gated")
+	public := signEvent(t, sk, 1, 1001, nostr.Tags{{"h", "group"}}, "public")
+	for _, event := range []*nostr.Event{gated, public} {
+		saveTestEvent(t, event)
+		indexVisibility(ctx, event)
+	}
+
+	filter := nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"h": []string{"group"}}}
+	if onlyGated, err := onlyGatedEvents(filter); err != nil || onlyGated {
+		t.Fatalf("expected public events to be counted, got %v (%v)", onlyGated, err)
+	}
+
+	if err := deleteEvent(ctx, public); err != nil {
+		t.Fatal(err)
+	}
+	if onlyGated, err := onlyGatedEvents(filter); err != nil || !onlyGated {
+		t.Fatalf("expected only gated events after the deletion, got %v (%v)", onlyGated, err)
+	}
+
+	if err := deleteEvent(ctx, gated); err != nil {
+		t.Fatal(err)
+	}
+	if built, err := hasEntries("visibility"); err != nil || built {
+		t.Fatalf("expected an empty index once everything is deleted, got %v (%v)", built, err)
+	}
+}
+
+func TestBuildVisibilityIndexCountsCrowdedSeconds(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	db.MaxLimit = 3
+
+	// the first page ends in the middle of second 5000
+	sk := nostr.GeneratePrivateKey()
+	saveTestEvent(t, signEvent(t, sk, 1, 6000, nostr.Tags{{"h", "group"}, {"f", "gold"}}, ""))
+	for i := 0; i < 2; i++ {
+		saveTestEvent(t, signEvent(t, sk, 1, 5000, nostr.Tags{{"h", "group"}, {"f", "gold"}}, string(rune('a'+i))))
+		saveTestEvent(t, signEvent(t, sk, 11, 5000, nostr.Tags{{"h", "group"}}, string(rune('a'+i))))
+	}
+	saveTestEvent(t, signEvent(t, sk, 7, 4000, nostr.Tags{{"h", "group"}}, "+"))
+
+	if err := buildVisibilityIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var visibility KindVisibility
+	if _, err := state.Get("visibility", visibilityKey("group", 1), &visibility); err != nil {
+		t.Fatal(err)
+	}
+	if visibility.Gated != 3 || visibility.Public != 0 {
+		t.Fatalf("expected 3 gated kind 1 events, got %+v", visibility)
+	}
+	if _, err := state.Get("visibility", visibilityKey("group", 11), &visibility); err != nil {
+		t.Fatal(err)
+	}
+	if visibility.Public != 2 {
+		t.Fatalf("expected 2 public kind 11 events, got %+v", visibility)
+	}
+	if _, err := state.Get("visibility", visibilityKey("group", 7), &visibility); err != nil {
+		t.Fatal(err)
+	}
+	if visibility.Public != 1 {
+		t.Fatalf("expected the reaction past the crowded second, got %+v", visibility)
+	}
+}
+
+func TestBuildVisibilityIndexRefusesToCutSecondsShort(t *testing.T) {
+	setupTestRelay(t)
+	db.MaxLimit = 3
+
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < 4; i++ {
+		saveTestEvent(t, signEvent(t, sk, 1, 5000, nostr.Tags{{"h", "group"}}, string(rune('a'+i))))
+	}
+
+	if err := buildVisibilityIndex(context.Background()); err == nil {
+		t.Fatal("expected an error for a second that can't be paged through")
+	}
+	if db.MaxLimit != 3 {
+		t.Fatalf("the query cap was changed to %d", db.MaxLimit)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// NIP-57 zaps.
+//
+// Zap receipts (kind 9735) are signed by the LNURL server that received the
+// payment, so we only believe the ones signed by the servers operators listed
+// in TrustedZapperPubkeys. The zap request (kind 9734) the subscriber signed is
+// embedded in the receipt's "description" tag and the invoice must commit to it
+// with its description hash. Subscribers point a zap at their kind 7001 with an
+// "e" tag in the zap request, otherwise it goes to their latest subscription to
+// the recipient. Like nutzaps, zaps can pay for the recipient's own group or for
+// one they can add members to, given with "h". Zaps are summed with tallyPayment.
+
+// serializes the recording of the invoices we've credited
+var zapsMutex sync.Mutex
+
+// ZapReceipt is a verified kind 9735
+type ZapReceipt struct {
+	ID        string
+	Recipient string
+	Sender    string
+	GroupID   string
+	Invoice   string
+	Msats     int64
+	// events referenced by the zap request
+	Refs []string
+}
+
+// bolt11Multipliers converts the amount in an invoice to msats
+var bolt11Multipliers = map[byte]func(int64) (int64, bool){
+	'm': func(n int64) (int64, bool) { return n * 100_000_000, true },
+	'u': func(n int64) (int64, bool) { return n * 100_000, true },
+	'n': func(n int64) (int64, bool) { return n * 100, true },
+	'p': func(n int64) (int64, bool) { return n / 10, n%10 == 0 },
+}
+
+// parseBolt11 returns the amount of a BOLT-11 invoice in msats and its
+// description hash, if it has one.
+func parseBolt11(invoice string) (msats int64, descriptionHash []byte, err error) {
+	hrp, data, err := bech32.DecodeNoLimit(strings.ToLower(invoice))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid invoice: %w", err)
+	}
+
+	// the hrp is ln + network + amount + multiplier, e.g. lnbc2500u
+	if !strings.HasPrefix(hrp, "ln") {
+		return 0, nil, fmt.Errorf("invalid invoice prefix")
+	}
+	amountStart := strings.IndexAny(hrp, "0123456789")
+	if amountStart == -1 {
+		return 0, nil, fmt.Errorf("invoice without amount")
+	}
+	amountStr := hrp[amountStart:]
+	multiplier, hasMultiplier := bolt11Multipliers[amountStr[len(amountStr)-1]]
+	if hasMultiplier {
+		amountStr = amountStr[:len(amountStr)-1]
+	}
+	amount, err := strconv.ParseInt(amountStr, 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, nil, fmt.Errorf("invalid invoice amount")
+	}
+	if !hasMultiplier {
+		msats = amount * 100_000_000_000
+	} else if msats, hasMultiplier = multiplier(amount); !hasMultiplier {
+		return 0, nil, fmt.Errorf("invalid invoice amount")
+	}
+
+	// the data is a 35 bit timestamp, then tagged fields (5 bits of type, 10 of
+	// length), then a 520 bit signature, all in 5 bit words
+	if len(data) < 7+104 {
+		return 0, nil, fmt.Errorf("invoice too short")
+	}
+	fields := data[7 : len(data)-104]
+	for len(fields) >= 3 {
+		fieldType := fields[0]
+		length := int(fields[1])<<5 | int(fields[2])
+		if len(fields) < 3+length {
+			return 0, nil, fmt.Errorf("invalid invoice field")
+		}
+		// 'h' is the description hash
+		if fieldType == 23 && length == 52 {
+			descriptionHash, err = bech32.ConvertBits(fields[3:3+length], 5, 8, false)
+			if err != nil {
+				return 0, nil, fmt.Errorf("invalid description hash: %w", err)
+			}
+		}
+		fields = fields[3+length:]
+	}
+
+	return msats, descriptionHash, nil
+}
+
+// verifyZapReceipt checks a receipt was issued by a zapper we trust, for the zap
+// request it embeds and for the amount it asked for.
+func verifyZapReceipt(event *nostr.Event) (*ZapReceipt, error) {
+	if event.Kind != 9735 {
+		return nil, fmt.Errorf("not a zap receipt")
+	}
+	if !slices.Contains(s.TrustedZapperPubkeys, event.PubKey) {
+		return nil, fmt.Errorf("receipt from an unknown zapper")
+	}
+
+	descriptionTag := event.Tags.GetFirst([]string{"description", ""})
+	if descriptionTag == nil {
+		return nil, fmt.Errorf("missing zap request ('description') tag")
+	}
+	var request nostr.Event
+	if err := json.Unmarshal([]byte((*descriptionTag)[1]), &request); err != nil {
+		return nil, fmt.Errorf("invalid zap request: %w", err)
+	}
+	if request.Kind != 9734 {
+		return nil, fmt.Errorf("zap request has the wrong kind")
+	}
+	if ok, err := request.CheckSignature(); err != nil || !ok {
+		return nil, fmt.Errorf("zap request has an invalid signature")
+	}
+
+	receipt := &ZapReceipt{ID: event.ID, Sender: request.PubKey}
+
+	pTag := event.Tags.GetFirst([]string{"p", ""})
+	requestPTag := request.Tags.GetFirst([]string{"p", ""})
+	if pTag == nil || requestPTag == nil || (*pTag)[1] != (*requestPTag)[1] {
+		return nil, fmt.Errorf("receipt recipient doesn't match the zap request")
+	}
+	receipt.Recipient = (*pTag)[1]
+	if senderTag := event.Tags.GetFirst([]string{"P", ""}); senderTag != nil && (*senderTag)[1] != request.PubKey {
+		return nil, fmt.Errorf("receipt sender doesn't match the zap request")
+	}
+
+	bolt11Tag := event.Tags.GetFirst([]string{"bolt11", ""})
+	if bolt11Tag == nil {
+		return nil, fmt.Errorf("missing 'bolt11' tag")
+	}
+	receipt.Invoice = strings.ToLower((*bolt11Tag)[1])
+	msats, descriptionHash, err := parseBolt11(receipt.Invoice)
+	if err != nil {
+		return nil, err
+	}
+	if descriptionHash == nil {
+		return nil, fmt.Errorf("invoice has no description hash")
+	}
+	if hash := sha256.Sum256([]byte((*descriptionTag)[1])); !bytes.Equal(hash[:], descriptionHash) {
+		return nil, fmt.Errorf("invoice wasn't issued for this zap request")
+	}
+	if amountTag := request.Tags.GetFirst([]string{"amount", ""}); amountTag != nil {
+		if requested, err := strconv.ParseInt((*amountTag)[1], 10, 64); err != nil || requested != msats {
+			return nil, fmt.Errorf("invoice amount doesn't match the zap request")
+		}
+	}
+	receipt.Msats = msats
+
+	// the group is the recipient's own unless the zap request says otherwise
+	receipt.GroupID = receipt.Recipient
+	if groupId := getGroupIdFromEvent(&request, "h"); groupId != "" {
+		receipt.GroupID = groupId
+	}
+	if groupId := getGroupIdFromEvent(event, "h"); groupId != "" && groupId != receipt.GroupID {
+		return nil, fmt.Errorf("receipt group doesn't match the zap request")
+	}
+
+	for _, tag := range request.Tags.GetAll([]string{"e", ""}) {
+		receipt.Refs = append(receipt.Refs, tag[1])
+	}
+
+	return receipt, nil
+}
+
+// validateZapReceipts rejects zap receipts we can't verify and the ones for a
+// group the recipient can't sell memberships to.
+func validateZapReceipts(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.Kind != 9735 {
+		return false, ""
+	}
+
+	receipt, err := verifyZapReceipt(event)
+	if err != nil {
+		return true, "invalid: " + err.Error()
+	}
+	if err := canSellMemberships(ctx, receipt.Recipient, receipt.GroupID); err != nil {
+		return true, "invalid: " + err.Error()
+	}
+	if found, err := state.Get("zap-invoices", receipt.Invoice, new(string)); err != nil {
+		return true, "error: failed to check invoice"
+	} else if found {
+		return true, "duplicate: invoice was already receipted"
+	}
+
+	return false, ""
+}
+
+// ingestZapReceipt adds zaps, whose receipts have already been validated by
+// validateZapReceipts, to the tally of the subscription they pay for.
+func ingestZapReceipt(ctx context.Context, event *nostr.Event) {
+	if event.Kind != 9735 {
+		return
+	}
+
+	receipt, err := verifyZapReceipt(event)
+	if err != nil {
+		log.Warn().Err(err).Str("receipt", event.ID).Msg("saved an invalid zap receipt")
+		return
+	}
+
+	sub, err := findSubscription(ctx, receipt.Sender, receipt.Recipient, receipt.Refs)
+	if err != nil {
+		log.Info().Err(err).Str("receipt", event.ID).Msg("zap isn't for a subscription")
+		return
+	}
+	if sub.GroupID != receipt.GroupID {
+		log.Warn().Str("receipt", event.ID).Str("group", receipt.GroupID).Msg("zap for another group than its subscription")
+		return
+	}
+
+	if fresh, err := recordZapInvoice(receipt); err != nil {
+		log.Error().Err(err).Str("receipt", event.ID).Msg("failed to record zap invoice")
+		return
+	} else if !fresh {
+		log.Warn().Str("receipt", event.ID).Msg("invoice was already receipted, not counting it")
+		return
+	}
+
+	payment, err := tallyPayment(sub, event.ID, receipt.Msats/1000, "zap")
+	if err != nil {
+		log.Error().Err(err).Str("receipt", event.ID).Msg("failed to tally zap")
+		return
+	}
+	if payment == nil {
+		return
+	}
+
+	if err := creditPayment(ctx, *payment); err != nil {
+		log.Warn().Err(err).Str("receipt", event.ID).Msg("failed to credit zaps")
+	}
+}
+
+// recordZapInvoice marks an invoice as credited, so the same payment receipted
+// twice is only counted once. It returns false if it already was.
+func recordZapInvoice(receipt *ZapReceipt) (fresh bool, err error) {
+	zapsMutex.Lock()
+	defer zapsMutex.Unlock()
+
+	if found, err := state.Get("zap-invoices", receipt.Invoice, new(string)); err != nil {
+		return false, err
+	} else if found {
+		return false, nil
+	}
+	return true, state.Put("zap-invoices", receipt.Invoice, receipt.ID)
+}
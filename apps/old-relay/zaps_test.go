@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// lnurlServer is a stand-in for the LNURL server of a creator's lightning
+// wallet: it issues invoices for zap requests and, once they're "paid", signs
+// the zap receipts with its own nostr key.
+type lnurlServer struct {
+	sk     string
+	pubkey string
+}
+
+// newLNURLServer starts a zapper, trusted unless told otherwise
+func newLNURLServer(t *testing.T, trusted bool) *lnurlServer {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if trusted {
+		previous := s.TrustedZapperPubkeys
+		s.TrustedZapperPubkeys = append([]string{pubkey}, previous...)
+		t.Cleanup(func() { s.TrustedZapperPubkeys = previous })
+	}
+	return &lnurlServer{sk: sk, pubkey: pubkey}
+}
+
+// invoice makes a BOLT-11 invoice for msats committing to description, or to
+// nothing if it's empty. The signature is all zeros, nothing checks it.
+func (ln *lnurlServer) invoice(t *testing.T, msats int64, description string) string {
+	t.Helper()
+
+	hrp := "lnbc" + strconv.FormatInt(msats*10, 10) + "p"
+	data := make([]byte, 7) // timestamp
+
+	if description != "" {
+		hash := sha256.Sum256([]byte(description))
+		words, err := bech32.ConvertBits(hash[:], 8, 5, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, 23, byte(len(words)>>5), byte(len(words)&31))
+		data = append(data, words...)
+	}
+	data = append(data, make([]byte, 104)...)
+
+	invoice, err := bech32.Encode(hrp, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoice
+}
+
+// receipt pays a zap request and signs its receipt. invoiced is the amount of
+// the invoice, which should be the one in the request.
+func (ln *lnurlServer) receipt(t *testing.T, request *nostr.Event, invoiced int64) *nostr.Event {
+	t.Helper()
+
+	description, _ := json.Marshal(request)
+	tags := nostr.Tags{
+		{"p", request.Tags.GetFirst([]string{"p", ""}).Value()},
+		{"P", request.PubKey},
+		{"bolt11", ln.invoice(t, invoiced, string(description))},
+		{"description", string(description)},
+	}
+	if eTag := request.Tags.GetFirst([]string{"e", ""}); eTag != nil {
+		tags = append(tags, *eTag)
+	}
+	return signEvent(t, ln.sk, 9735, request.CreatedAt, tags, "")
+}
+
+func zapRequest(t *testing.T, sk string, recipient string, msats int64, tags ...nostr.Tag) *nostr.Event {
+	return signEvent(t, sk, 9734, nostr.Now(), append(nostr.Tags{
+		{"p", recipient},
+		{"amount", strconv.FormatInt(msats, 10)},
+		{"relays", "wss://relay.example.com"},
+	}, tags...), "")
+}
+
+func TestZapsPayForSubscriptions(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	zapper := newLNURLServer(t, true)
+
+	creatorSk := nostr.GeneratePrivateKey()
+	creator, _ := nostr.GetPublicKey(creatorSk)
+	subscriberSk := nostr.GeneratePrivateKey()
+	subscriber, _ := nostr.GetPublicKey(subscriberSk)
+
+	saveTestEvent(t, signEvent(t, creatorSk, 37001, nostr.Now(),
+		nostr.Tags{{"d", "gold"}, {"amount", "21", "sat", "monthly"}}, ""))
+	sub := signEvent(t, subscriberSk, 7001, nostr.Now(), nostr.Tags{
+		{"a", "37001:" + creator + ":gold"}, {"p", creator}, {"amount", "21", "sat", "monthly"},
+	}, "")
+	saveTestEvent(t, sub)
+
+	// two zaps make up the price
+	for i, msats := range []int64{15_000, 6_000} {
+		receipt := zapper.receipt(t, zapRequest(t, subscriberSk, creator, msats, nostr.Tag{"e", sub.ID}), msats)
+		if reject, msg := validateZapReceipts(ctx, receipt); reject {
+			t.Fatalf("zap %d rejected: %s", i, msg)
+		}
+		saveTestEvent(t, receipt)
+		ingestZapReceipt(ctx, receipt)
+
+		memberships, err := loadPaidMemberships(creator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paid := len(memberships) == 1 && memberships[0].Pubkey == subscriber; paid != (i == 1) {
+			t.Fatalf("after zap %d: memberships %v", i, memberships)
+		}
+
+		// the same payment can't be receipted again
+		if reject, msg := validateZapReceipts(ctx, receipt); !reject || !strings.HasPrefix(msg, "duplicate:") {
+			t.Fatalf("receipt for a credited invoice wasn't rejected as a duplicate: %s", msg)
+		}
+	}
+}
+
+func TestZapReceiptVerification(t *testing.T) {
+	setupTestRelay(t)
+	trusted := newLNURLServer(t, true)
+	untrusted := newLNURLServer(t, false)
+
+	senderSk := nostr.GeneratePrivateKey()
+	creator, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	other, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	forged := trusted.receipt(t, zapRequest(t, senderSk, creator, 21_000), 21_000)
+	forged.Tags = append(forged.Tags, nostr.Tag{"h", other})
+	forged.Sign(trusted.sk)
+
+	tampered := trusted.receipt(t, zapRequest(t, senderSk, creator, 21_000), 21_000)
+	var request nostr.Event
+	json.Unmarshal([]byte(tampered.Tags.GetFirst([]string{"description", ""}).Value()), &request)
+	request.Content = "changed after signing"
+	description, _ := json.Marshal(request)
+	for _, tag := range tampered.Tags {
+		if tag[0] == "description" {
+			tag[1] = string(description)
+		}
+	}
+	tampered.Sign(trusted.sk)
+
+	// invoices that don't commit to the zap request, or commit to another one
+	withInvoice := func(description string) *nostr.Event {
+		receipt := trusted.receipt(t, zapRequest(t, senderSk, creator, 21_000), 21_000)
+		for _, tag := range receipt.Tags {
+			if tag[0] == "bolt11" {
+				tag[1] = trusted.invoice(t, 21_000, description)
+			}
+		}
+		receipt.Sign(trusted.sk)
+		return receipt
+	}
+
+	for name, tc := range map[string]struct {
+		receipt *nostr.Event
+		err     string
+	}{
+		"valid":                {trusted.receipt(t, zapRequest(t, senderSk, creator, 21_000), 21_000), ""},
+		"unknown zapper":       {untrusted.receipt(t, zapRequest(t, senderSk, creator, 21_000), 21_000), "unknown zapper"},
+		"underpaid":            {trusted.receipt(t, zapRequest(t, senderSk, creator, 21_000), 2_100), "amount"},
+		"group not in request": {forged, "group"},
+		"tampered request":     {tampered, "signature"},
+		"no description hash":  {withInvoice(""), "description hash"},
+		"other zap request":    {withInvoice("{}"), "wasn't issued"},
+	} {
+		receipt, err := verifyZapReceipt(tc.receipt)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %s", name, err)
+		case tc.err == "" && (receipt.Msats != 21_000 || receipt.Recipient != creator || receipt.GroupID != creator):
+			t.Errorf("%s: wrong receipt %+v", name, receipt)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected an error about %q, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestZapsForAnotherGroup(t *testing.T) {
+	setupTestRelay(t)
+	ctx := context.Background()
+	zapper := newLNURLServer(t, true)
+
+	senderSk := nostr.GeneratePrivateKey()
+	creator, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := createGroup(ctx, "victim", owner, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := createGroup(ctx, "run-by-creator", creator, GroupSetup{}); err != nil {
+		t.Fatal(err)
+	}
+
+	hijack := zapper.receipt(t, zapRequest(t, senderSk, creator, 21_000, nostr.Tag{"h", "victim"}), 21_000)
+	if reject, msg := validateZapReceipts(ctx, hijack); !reject || !strings.Contains(msg, "admin") {
+		t.Fatalf("zap for a group the recipient doesn't run wasn't rejected: %s", msg)
+	}
+
+	// the same rule as nutzaps: admins who can add members can sell memberships
+	zap := zapper.receipt(t, zapRequest(t, senderSk, creator, 21_000, nostr.Tag{"h", "run-by-creator"}), 21_000)
+	if reject, msg := validateZapReceipts(ctx, zap); reject {
+		t.Fatalf("zap for a group the recipient runs was rejected: %s", msg)
+	}
+}
+
+func TestTalliesCountEachReceiptOnce(t *testing.T) {
+	setupTestRelay(t)
+
+	sub := &Subscription{
+		ID:        "subscription",
+		Amount:    TierAmount{Amount: 21, Currency: "sat", Cadence: "monthly"},
+		CreatedAt: nostr.Now(),
+	}
+
+	if payment, err := tallyPayment(sub, "nutzap", 16, "nutzap"); err != nil || payment != nil {
+		t.Fatalf("16 sats paid for a 21 sats subscription: %v %v", payment, err)
+	}
+	if payment, err := tallyPayment(sub, "nutzap", 16, "nutzap"); err != nil || payment != nil {
+		t.Fatalf("nutzap counted twice: %v %v", payment, err)
+	}
+	payment, err := tallyPayment(sub, "zap", 5, "zap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment == nil || payment.Amount.Amount != 21 || payment.Receipt != "zap" {
+		t.Fatalf("expected the tally to cover the price, got %v", payment)
+	}
+}